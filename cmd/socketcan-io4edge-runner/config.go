@@ -0,0 +1,150 @@
+/*
+Copyright © 2022 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// deviceConfig is a statically configured io4edge device
+type deviceConfig struct {
+	// io4edge device address: either ip:port or the mdns instance name, e.g. MIO04-1-can
+	Address string `yaml:"address"`
+	// name of the vcan interface
+	VCan string `yaml:"vcan"`
+	// socketcan-io4edge options
+	BitRate       uint32        `yaml:"bitrate"`
+	SamplePoint   float32       `yaml:"samplepoint"`
+	SJW           uint8         `yaml:"sjw"`
+	ListenOnly    bool          `yaml:"listenonly"`
+	BusOffRestart time.Duration `yaml:"busoffrestart"`
+	FD            bool          `yaml:"fd"`
+	Echo          bool          `yaml:"echo"`
+	TxPolicy      string        `yaml:"txpolicy"`
+	TxRateLimit   string        `yaml:"txratelimit"`
+	Filter        string        `yaml:"filter"`
+	HwFilter      string        `yaml:"hwfilter"`
+	Verbose       bool          `yaml:"verbose"`
+}
+
+// runnerConfig is the content of the runner configuration file
+type runnerConfig struct {
+	// if true, devices not listed in Devices are discovered via mdns. Default: true
+	MDNS    *bool          `yaml:"mdns"`
+	Devices []deviceConfig `yaml:"devices"`
+}
+
+func loadConfig(path string) (*runnerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &runnerConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *runnerConfig) validate() error {
+	vcans := make(map[string]bool)
+	for i, d := range c.Devices {
+		if d.Address == "" {
+			return fmt.Errorf("device %d: address missing", i)
+		}
+		if d.VCan == "" {
+			return fmt.Errorf("device %s: vcan missing", d.Address)
+		}
+		if len(d.VCan) > 15 {
+			return fmt.Errorf("device %s: vcan name %s longer than 15 characters", d.Address, d.VCan)
+		}
+		if d.BusOffRestart != 0 && d.BitRate == 0 {
+			return fmt.Errorf("device %s: busoffrestart requires bitrate", d.Address)
+		}
+		if vcans[d.VCan] {
+			return fmt.Errorf("device %s: vcan %s used twice", d.Address, d.VCan)
+		}
+		vcans[d.VCan] = true
+	}
+	return nil
+}
+
+// mdnsEnabled returns true if devices shall be discovered via mdns
+func (c *runnerConfig) mdnsEnabled() bool {
+	return c.MDNS == nil || *c.MDNS
+}
+
+// deviceByAddress returns the configuration of the device with the given address or nil if not configured
+func (c *runnerConfig) deviceByAddress(address string) *deviceConfig {
+	for i := range c.Devices {
+		if c.Devices[i].Address == address {
+			return &c.Devices[i]
+		}
+	}
+	return nil
+}
+
+// gatewayArgs returns the socketcan-io4edge options for the device
+func (d *deviceConfig) gatewayArgs() []string {
+	args := []string{}
+
+	if d.Verbose {
+		args = append(args, "-v")
+	}
+	if d.BitRate != 0 {
+		args = append(args, "-bitrate", strconv.FormatUint(uint64(d.BitRate), 10))
+		if d.SamplePoint != 0 {
+			args = append(args, "-samplepoint", strconv.FormatFloat(float64(d.SamplePoint), 'f', -1, 32))
+		}
+		if d.SJW != 0 {
+			args = append(args, "-sjw", strconv.Itoa(int(d.SJW)))
+		}
+		if d.ListenOnly {
+			args = append(args, "-listenonly")
+		}
+		if d.BusOffRestart != 0 {
+			args = append(args, "-busoff-restart", d.BusOffRestart.String())
+		}
+	}
+	if d.FD {
+		args = append(args, "-fd")
+	}
+	if d.Echo {
+		args = append(args, "-echo")
+	}
+	if d.TxPolicy != "" {
+		args = append(args, "-tx-policy", d.TxPolicy)
+	}
+	if d.TxRateLimit != "" {
+		args = append(args, "-tx-ratelimit", d.TxRateLimit)
+	}
+	if d.Filter != "" {
+		args = append(args, "-filter", d.Filter)
+	}
+	if d.HwFilter != "" {
+		args = append(args, "-hwfilter", d.HwFilter)
+	}
+	return args
+}
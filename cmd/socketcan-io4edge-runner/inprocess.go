@@ -0,0 +1,178 @@
+/*
+Copyright © 2022 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/gateway"
+)
+
+// gatewayRetryDelay is the time after which a failed in-process gateway is started again
+const gatewayRetryDelay = 5 * time.Second
+
+// gatewayStart is an in-process gateway whose Start is in progress. cancel aborts the start or stops the gateway.
+type gatewayStart struct {
+	cancel context.CancelFunc
+}
+
+// gatewayConfig returns the in-process gateway configuration for the device
+func (d *deviceConfig) gatewayConfig() (gateway.Config, error) {
+	cfg := gateway.Config{
+		Address:   d.Address,
+		Interface: d.VCan,
+		FDMode:    d.FD,
+		TxEcho:    d.Echo,
+		Verbose:   d.Verbose,
+	}
+	if d.BitRate != 0 {
+		cfg.Bus = &gateway.BusConfig{
+			BitRate:     d.BitRate,
+			SamplePoint: d.SamplePoint,
+			SJW:         d.SJW,
+			ListenOnly:  d.ListenOnly,
+		}
+		// same defaults as socketcan-io4edge
+		if cfg.Bus.SamplePoint == 0 {
+			cfg.Bus.SamplePoint = 0.8
+		}
+		if cfg.Bus.SJW == 0 {
+			cfg.Bus.SJW = 1
+		}
+		cfg.BusOffRestart = d.BusOffRestart
+	}
+	if d.Filter != "" {
+		var err error
+		cfg.Filters, err = gateway.ParseFilters(d.Filter)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if d.HwFilter != "" {
+		var err error
+		cfg.AcceptanceFilter, err = gateway.ParseAcceptanceFilter(d.HwFilter)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if d.TxPolicy != "" {
+		var err error
+		cfg.TxPolicy, err = gateway.ParseTxPolicy(d.TxPolicy)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if d.TxRateLimit != "" {
+		var err error
+		cfg.TxRateLimits, err = gateway.ParseTxRateLimits(d.TxRateLimit)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// startGateway runs the gateway for the device in this process.
+// Start resolves and connects to the device, so it runs without mu, the result is recorded with mu held.
+func (d *daemonInfo) startGateway(name string) {
+	cfg := gateway.Config{
+		Address:   d.io4edgeInstanceName,
+		Interface: name,
+	}
+	if d.cfg != nil {
+		var err error
+		cfg, err = d.cfg.gatewayConfig()
+		if err != nil {
+			logErr("%s: invalid configuration: %v\n", name, err)
+			return
+		}
+	}
+	cfg.Verbose = cfg.Verbose || verbose
+	cfg.LogPrefix = name + ": "
+	cfg.Metrics = gatewayMetrics
+
+	fmt.Printf("%s: starting gateway\n", name)
+	gw := gateway.New(cfg)
+	ctx, cancel := context.WithCancel(runnerCtx)
+	start := &gatewayStart{cancel: cancel}
+	d.starting = start
+
+	go func() {
+		err := gw.Start(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		if d.starting != start {
+			// stopped while starting, a started gateway terminates because ctx is cancelled
+			cancel()
+			return
+		}
+		d.starting = nil
+		if err != nil {
+			cancel()
+			logErr("%s: start gateway failed: %v\n", name, err)
+			d.retryGateway(name)
+			return
+		}
+		d.gw = gw
+		publishStatus(name, d)
+		go d.watchGateway(name, gw)
+	}()
+}
+
+// watchGateway waits until the gateway terminates and restarts it after a fatal error
+func (d *daemonInfo) watchGateway(name string, gw *gateway.Gateway) {
+	<-gw.Done()
+	mu.Lock()
+	defer mu.Unlock()
+	if d.gw == gw {
+		d.gw = nil
+		publishStatus(name, d)
+	}
+	if err := gw.Err(); err != nil {
+		logErr("%s: gateway terminated: %v\n", name, err)
+		d.retryGateway(name)
+	}
+}
+
+// retryGateway starts the gateway again after gatewayRetryDelay, if the device is still known and its link is up
+func (d *daemonInfo) retryGateway(name string) {
+	time.AfterFunc(gatewayRetryDelay, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if runnerCtx.Err() != nil || daemonMap[name] != d || !socketCANIsUp(name) {
+			return
+		}
+		d.startProcess(name)
+	})
+}
+
+func (d *daemonInfo) stopGateway(name string) {
+	if d.starting != nil {
+		// the pending start stops the gateway when it returns
+		fmt.Printf("%s: cancelling gateway start\n", name)
+		d.starting.cancel()
+		d.starting = nil
+	}
+	if d.gw != nil {
+		fmt.Printf("%s: stopping gateway\n", name)
+		d.gw.Stop()
+		d.gw = nil
+		publishStatus(name, d)
+	}
+}
@@ -17,24 +17,36 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ci4rail/io4edge-client-go/client"
+	"github.com/ci4rail/socketcan-io4edge/internal/metrics"
 	"github.com/ci4rail/socketcan-io4edge/internal/version"
 	"github.com/ci4rail/socketcan-io4edge/pkg/drunner"
+	"github.com/ci4rail/socketcan-io4edge/pkg/gateway"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vishvananda/netlink"
 )
 
 type daemonInfo struct {
 	runner              *drunner.Runner
-	io4edgeInstanceName string
+	gw                  *gateway.Gateway // used instead of runner in in-process mode
+	starting            *gatewayStart    // in-process gateway that is being started
+	io4edgeInstanceName string           // for statically configured devices, this can also be ip:port
 	ipPort              string
+	cfg                 *deviceConfig // nil for devices discovered via mdns
+	vcanCreated         bool          // vcan has been created by the runner
+	linkDown            bool          // last operstate of the vcan reported by netlink was down
 }
 
 var (
@@ -42,6 +54,16 @@ var (
 	daemonMap   = make(map[string]*daemonInfo) // key: vcan name
 	programPath string
 	verbose     bool
+	config      = &runnerConfig{}
+	vcanCreate  bool
+	vcanTxQLen  int
+	gracePeriod time.Duration
+	policy      = drunner.DefaultRestartPolicy
+	inProcess   bool
+	// gatewayMetrics are shared by the in-process gateways, each gateway uses its interface as label
+	gatewayMetrics *gateway.Metrics
+	// runnerCtx is cancelled on shutdown to stop all runners
+	runnerCtx, cancelRunners = context.WithCancel(context.Background())
 )
 
 func main() {
@@ -49,6 +71,7 @@ func main() {
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] <socketcan-io4edge-program-path>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -inprocess [OPTIONS]\n", os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -56,15 +79,31 @@ func main() {
 	logLevel := flag.String("loglevel", "info", "io4edge-client-go loglevel (debug, info, warn, error)")
 	showVersion := flag.Bool("version", false, "show version and exit")
 	verboseP := flag.Bool("v", false, "run socketcan-io4edge in verbose mode")
+	configPath := flag.String("config", "", "static device configuration file (yaml)")
+	vcanCreateP := flag.Bool("create-vcan", false, "create the vcan interfaces for discovered and configured devices and remove them when the device disappears")
+	vcanTxQLenP := flag.Int("vcan-txqueuelen", 0, "tx queue length of created vcan interfaces (0: kernel default)")
+	gracePeriodP := flag.Duration("grace", drunner.DefaultGracePeriod, "time to wait for socketcan-io4edge to terminate after SIGTERM before it is killed")
+	maxBackoff := flag.Duration("restart-backoff", drunner.DefaultRestartPolicy.MaxBackoff, "maximum delay before socketcan-io4edge is restarted")
+	maxRestarts := flag.Int("max-restarts", 0, "give up restarting socketcan-io4edge after this number of terminations within -restart-window (0: unlimited)")
+	restartWindow := flag.Duration("restart-window", drunner.DefaultRestartPolicy.Window, "time window for -max-restarts")
+	inProcessP := flag.Bool("inprocess", false, "run the gateways in this process instead of starting socketcan-io4edge processes")
+	metricsAddr := flag.String("metrics", "", "serve prometheus metrics on this address (e.g. :9101) under /metrics")
 	flag.Parse()
 	if *showVersion {
 		fmt.Printf("%s\n", version.Version)
 		os.Exit(0)
 	}
-	if flag.NArg() != 1 {
+	inProcess = *inProcessP
+	if (inProcess && flag.NArg() != 0) || (!inProcess && flag.NArg() != 1) {
 		flag.Usage()
 	}
 	verbose = *verboseP
+	vcanCreate = *vcanCreateP
+	vcanTxQLen = *vcanTxQLenP
+	gracePeriod = *gracePeriodP
+	policy.MaxBackoff = *maxBackoff
+	policy.MaxRestarts = *maxRestarts
+	policy.Window = *restartWindow
 	level, err := log.ParseLevel(*logLevel)
 
 	if err != nil {
@@ -72,19 +111,68 @@ func main() {
 	}
 	log.SetLevel(level)
 
-	programPath = flag.Arg(0)
-	_, err = os.Stat(programPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Fatalf("error: %s: path not exists!", os.Args[0])
-		} else {
-			log.Fatalf("error: %v", err)
+	if *configPath != "" {
+		config, err = loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("error loading config: %v", err)
+		}
+	}
+
+	if !inProcess {
+		programPath = flag.Arg(0)
+		_, err = os.Stat(programPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Fatalf("error: %s: path not exists!", os.Args[0])
+			} else {
+				log.Fatalf("error: %v", err)
+			}
 		}
 	}
+	if *metricsAddr != "" {
+		prometheus.MustRegister(newDaemonCollector())
+		if inProcess {
+			gatewayMetrics = gateway.NewMetrics()
+			prometheus.MustRegister(gatewayMetrics)
+		}
+		metrics.Serve(*metricsAddr)
+	}
 	// watch for socketcan link status changes
 	go netlinkMonitor()
-	// watch for mdns service changes
-	client.ServiceObserver("_io4edge_canL2._tcp", serviceAdded, serviceRemoved)
+	go shutdownOnSignal()
+
+	// start statically configured devices
+	startStaticDevices()
+
+	if config.mdnsEnabled() {
+		// watch for mdns service changes
+		client.ServiceObserver("_io4edge_canL2._tcp", serviceAdded, serviceRemoved)
+	} else {
+		select {}
+	}
+}
+
+func startStaticDevices() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for i := range config.Devices {
+		cfg := &config.Devices[i]
+		daemon := &daemonInfo{
+			io4edgeInstanceName: cfg.Address,
+			cfg:                 cfg,
+		}
+		daemonMap[cfg.VCan] = daemon
+		publishStatus(cfg.VCan, daemon)
+		fmt.Printf("%s: statically configured device %s\n", cfg.VCan, cfg.Address)
+		daemon.createVCan(cfg.VCan)
+
+		if socketCANIsUp(cfg.VCan) {
+			daemon.startProcess(cfg.VCan)
+		} else {
+			fmt.Printf("%s: socketcan link is down, don't start process\n", cfg.VCan)
+		}
+	}
 }
 
 func serviceAdded(s client.ServiceInfo) error {
@@ -95,6 +183,11 @@ func serviceAdded(s client.ServiceInfo) error {
 	var daemon *daemonInfo
 	fmt.Printf("%s: service added info received from mdns\n", s.GetInstanceName())
 
+	if config.deviceByAddress(s.GetInstanceName()) != nil {
+		fmt.Printf("%s: statically configured (ignoring)\n", s.GetInstanceName())
+		return nil
+	}
+
 	name := vcanName(s.GetInstanceName())
 	ipPort := s.GetIPAddressPort()
 
@@ -105,18 +198,21 @@ func serviceAdded(s client.ServiceInfo) error {
 		daemon.ipPort = ipPort
 		daemon.io4edgeInstanceName = s.GetInstanceName()
 		daemonMap[name] = daemon
+		publishStatus(name, daemon)
+		daemon.createVCan(name)
 	} else {
 		// instance already exists, check if ip or port changed
 		if daemon.ipPort == ipPort {
 			fmt.Printf("%s: no change in ip/port (nothing to do)\n", name)
 			return nil
 		}
-		// ip or port changed, kill old instance and start new one
-		daemon.ipPort = ipPort
-		if daemon.runner != nil {
+		// ip or port changed, kill old instance and start new one.
+		// Stop returns when the old process has exited, so the processes never overlap on the vcan
+		if daemon.runner != nil || daemon.gw != nil || daemon.starting != nil {
 			fmt.Printf("%s: ip/port changed, %s->%s stop old instance\n", name, daemon.ipPort, ipPort)
-			daemon.runner.Stop()
+			daemon.stopProcess(name)
 		}
+		daemon.ipPort = ipPort
 	}
 
 	if socketCANIsUp(name) {
@@ -135,9 +231,15 @@ func serviceRemoved(s client.ServiceInfo) error {
 	name := vcanName(s.GetInstanceName())
 	fmt.Printf("%s: service removed info received from mdns\n", s.GetInstanceName())
 
+	if config.deviceByAddress(s.GetInstanceName()) != nil {
+		fmt.Printf("%s: statically configured (ignoring)\n", s.GetInstanceName())
+		return nil
+	}
+
 	daemon, ok := daemonMap[name]
 	if ok {
 		daemon.stopProcess(name)
+		daemon.deleteVCan(name)
 		delDaemon(name)
 	} else {
 		fmt.Printf("%s: instance not known! (ignoring)\n", name)
@@ -157,34 +259,107 @@ func vcanName(instanceName string) string {
 }
 
 func (d *daemonInfo) startProcess(name string) {
+	if d.runner != nil || d.gw != nil || d.starting != nil {
+		// already running
+		return
+	}
+	if inProcess {
+		d.startGateway(name)
+		return
+	}
 	args := []string{}
 
-	if verbose {
+	if d.cfg != nil {
+		args = append(args, d.cfg.gatewayArgs()...)
+	}
+	if verbose && (d.cfg == nil || !d.cfg.Verbose) {
 		args = append(args, "-v")
 	}
 	args = append(args, d.io4edgeInstanceName, name)
 
-	runner, err := drunner.New(name, programPath, args...)
-	if err != nil {
+	runner := drunner.New(name, programPath, args...)
+	runner.SetGracePeriod(gracePeriod)
+	runner.SetRestartPolicy(policy)
+	runner.OnStateChange(func(s drunner.State) {
+		fmt.Printf("%s: runner state %v\n", name, s)
+	})
+	if err := runner.Start(runnerCtx); err != nil {
 		logErr("%s: start %s failed: %v\n", name, programPath, err)
+		return
 	}
 	d.runner = runner
+	publishStatus(name, d)
 }
 
 func (d *daemonInfo) stopProcess(name string) {
+	d.stopGateway(name)
 	if d.runner != nil {
 		fmt.Printf("%s: stopping process\n", name)
 		d.runner.Stop()
 		d.runner = nil
+		publishStatus(name, d)
+	}
+}
+
+// createVCan creates the vcan interface for the device, if vcan creation is enabled
+func (d *daemonInfo) createVCan(name string) {
+	if !vcanCreate {
+		return
+	}
+	fd := d.cfg != nil && d.cfg.FD
+	created, err := createVCan(name, fd, vcanTxQLen)
+	if err != nil {
+		logErr("%s: %v\n", name, err)
+		return
+	}
+	if created {
+		fmt.Printf("%s: created vcan interface\n", name)
+		d.vcanCreated = true
 	}
 }
 
+// deleteVCan removes the vcan interface for the device, if it has been created by the runner
+func (d *daemonInfo) deleteVCan(name string) {
+	if !d.vcanCreated {
+		return
+	}
+	if err := deleteVCan(name); err != nil {
+		logErr("%s: can't delete vcan interface: %v\n", name, err)
+		return
+	}
+	fmt.Printf("%s: deleted vcan interface\n", name)
+	d.vcanCreated = false
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, stops all daemons, removes the vcans created by the runner and exits
+func shutdownOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	fmt.Printf("got %v, stopping all processes\n", sig)
+
+	mu.Lock()
+	// stop all runners in parallel and wait until all processes have exited
+	cancelRunners()
+	for name, daemon := range daemonMap {
+		if daemon.runner != nil {
+			daemon.runner.Wait()
+		}
+		if daemon.gw != nil {
+			<-daemon.gw.Done()
+		}
+		daemon.deleteVCan(name)
+	}
+	os.Exit(0)
+}
+
 func logErr(format string, arg ...any) {
 	fmt.Fprintf(os.Stderr, format, arg...)
 }
 
 func delDaemon(name string) {
 	delete(daemonMap, name)
+	publishStatus(name, nil)
 }
 
 func socketCANIsUp(name string) bool {
@@ -212,8 +387,11 @@ func netlinkMonitor() {
 		daemon, ok := daemonMap[name]
 		if ok {
 			if !down {
+				// a failed runner has been removed when the link went down, so it starts again after down->up
+				daemon.linkDown = false
 				daemon.startProcess(name)
-			} else {
+			} else if !daemon.linkDown {
+				daemon.linkDown = true
 				daemon.stopProcess(name)
 			}
 		}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/ci4rail/socketcan-io4edge/pkg/gateway"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -13,3 +18,81 @@ func TestVCanName(t *testing.T) {
 	assert.Equal(t, "vcan12345678901", vcanName("12345678901"))
 	assert.Equal(t, "vcan1234xx89012", vcanName("123456789012"))
 }
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+mdns: false
+devices:
+  - address: 192.168.0.10:10000
+    vcan: vcanBrake
+    bitrate: 250000
+    samplepoint: 0.875
+    busoffrestart: 100ms
+    filter: 100:700
+    verbose: true
+  - address: MIO04-1-can
+    vcan: vcanDoor
+`), 0644)
+	assert.Nil(t, err)
+
+	cfg, err := loadConfig(path)
+	assert.Nil(t, err)
+	assert.False(t, cfg.mdnsEnabled())
+	assert.Equal(t, 2, len(cfg.Devices))
+	assert.Equal(t, "vcanDoor", cfg.deviceByAddress("MIO04-1-can").VCan)
+	assert.Nil(t, cfg.deviceByAddress("MIO04-2-can"))
+	assert.Equal(t, []string{"-v", "-bitrate", "250000", "-samplepoint", "0.875", "-busoff-restart", "100ms", "-filter", "100:700"},
+		cfg.Devices[0].gatewayArgs())
+	assert.Equal(t, []string{}, cfg.Devices[1].gatewayArgs())
+
+	assert.True(t, (&runnerConfig{}).mdnsEnabled())
+}
+
+func TestConfigValidation(t *testing.T) {
+	assert.NotNil(t, (&runnerConfig{Devices: []deviceConfig{{VCan: "vcan0"}}}).validate())
+	assert.NotNil(t, (&runnerConfig{Devices: []deviceConfig{{Address: "a"}}}).validate())
+	assert.NotNil(t, (&runnerConfig{Devices: []deviceConfig{{Address: "a", VCan: "vcan0123456789012"}}}).validate())
+	assert.NotNil(t, (&runnerConfig{Devices: []deviceConfig{{Address: "a", VCan: "vcan0"}, {Address: "b", VCan: "vcan0"}}}).validate())
+	assert.Nil(t, (&runnerConfig{Devices: []deviceConfig{{Address: "a", VCan: "vcan0"}, {Address: "b", VCan: "vcan1"}}}).validate())
+}
+
+func TestGatewayConfig(t *testing.T) {
+	d := &deviceConfig{Address: "MIO04-1-can", VCan: "vcanDoor", BitRate: 250000, ListenOnly: true, BusOffRestart: time.Second}
+	cfg, err := d.gatewayConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "MIO04-1-can", cfg.Address)
+	assert.Equal(t, "vcanDoor", cfg.Interface)
+	// same defaults as socketcan-io4edge
+	assert.Equal(t, &gateway.BusConfig{BitRate: 250000, SamplePoint: 0.8, SJW: 1, ListenOnly: true}, cfg.Bus)
+	assert.Equal(t, time.Second, cfg.BusOffRestart)
+
+	// without bitrate, the configuration persisted in the device is used
+	cfg, err = (&deviceConfig{Address: "MIO04-1-can", VCan: "vcanDoor", BusOffRestart: time.Second}).gatewayConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, cfg.Bus)
+	assert.Equal(t, time.Duration(0), cfg.BusOffRestart)
+}
+
+func TestCollectDoesNotWaitForMu(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newDaemonCollector())
+	publishStatus("vcanTest", &daemonInfo{})
+	defer publishStatus("vcanTest", nil)
+
+	// e.g. stopping processes holds mu for the grace period
+	mu.Lock()
+	defer mu.Unlock()
+	done := make(chan int)
+	go func() {
+		families, err := reg.Gather()
+		assert.Nil(t, err)
+		done <- len(families)
+	}()
+	select {
+	case n := <-done:
+		assert.Equal(t, 4, n)
+	case <-time.After(time.Second):
+		t.Fatal("scrape blocked")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2022 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/drunner"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// daemonStatus is the part of a daemon exposed as metrics. It is kept apart from daemonMap, so that a scrape
+// doesn't wait for mu, which is held while processes are stopped.
+type daemonStatus struct {
+	runner  *drunner.Runner // its methods don't need mu
+	gateway bool            // an in-process gateway is running
+}
+
+var (
+	statusMu  sync.Mutex                      // protects statusMap
+	statusMap = make(map[string]daemonStatus) // key: vcan name
+)
+
+// publishStatus updates the status of the daemon name after d.runner or d.gw changed. d nil removes it.
+// Must be called with mu held.
+func publishStatus(name string, d *daemonInfo) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if d == nil {
+		delete(statusMap, name)
+		return
+	}
+	statusMap[name] = daemonStatus{runner: d.runner, gateway: d.gw != nil}
+}
+
+// daemonCollector exposes the status of the daemons
+type daemonCollector struct {
+	restarts *prometheus.Desc
+	running  *prometheus.Desc
+	state    *prometheus.Desc
+	exitCode *prometheus.Desc
+}
+
+func newDaemonCollector() *daemonCollector {
+	return &daemonCollector{
+		restarts: prometheus.NewDesc("socketcan_io4edge_runner_restarts_total",
+			"Number of restarts of the socketcan-io4edge process", []string{"vcan"}, nil),
+		running: prometheus.NewDesc("socketcan_io4edge_runner_running",
+			"1 if a socketcan-io4edge process or in-process gateway is started for the device", []string{"vcan"}, nil),
+		state: prometheus.NewDesc("socketcan_io4edge_runner_state",
+			"State of the socketcan-io4edge runner (1 for the active state)", []string{"vcan", "state"}, nil),
+		exitCode: prometheus.NewDesc("socketcan_io4edge_runner_last_exit_code",
+			"Exit code of the last terminated socketcan-io4edge process", []string{"vcan"}, nil),
+	}
+}
+
+func (c *daemonCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.restarts
+	ch <- c.running
+	ch <- c.state
+	ch <- c.exitCode
+}
+
+func (c *daemonCollector) Collect(ch chan<- prometheus.Metric) {
+	statusMu.Lock()
+	snapshot := make(map[string]daemonStatus, len(statusMap))
+	for name, st := range statusMap {
+		snapshot[name] = st
+	}
+	statusMu.Unlock()
+
+	for name, st := range snapshot {
+		var restarts uint64
+		var running float64
+		state := drunner.StateStopped
+		exitCode := -1
+		if st.runner != nil {
+			restarts = st.runner.Restarts()
+			running = 1
+			state = st.runner.State()
+			exitCode = st.runner.LastExitCode()
+		}
+		if st.gateway {
+			running = 1
+			state = drunner.StateRunning
+		}
+		ch <- prometheus.MustNewConstMetric(c.restarts, prometheus.CounterValue, float64(restarts), name)
+		ch <- prometheus.MustNewConstMetric(c.running, prometheus.GaugeValue, running, name)
+		ch <- prometheus.MustNewConstMetric(c.exitCode, prometheus.GaugeValue, float64(exitCode), name)
+		for _, s := range []drunner.State{drunner.StateRunning, drunner.StateBackingOff, drunner.StateFailed, drunner.StateStopped} {
+			var v float64
+			if s == state {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, v, name, s.String())
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2022 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	canMTU   = 16 // sizeof(struct can_frame)
+	canFDMTU = 72 // sizeof(struct canfd_frame)
+)
+
+// createVCan creates the vcan interface name and brings it up.
+// If txQLen > 0, the tx queue length of the interface is set.
+// Returns false if the interface already exists. In this case, it is not modified.
+func createVCan(name string, fd bool, txQLen int) (bool, error) {
+	if _, err := netlink.LinkByName(name); err == nil {
+		return false, nil
+	}
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.MTU = canMTU
+	if fd {
+		attrs.MTU = canFDMTU
+	}
+	if txQLen > 0 {
+		attrs.TxQLen = txQLen
+	}
+	link := &netlink.GenericLink{
+		LinkAttrs: attrs,
+		LinkType:  "vcan",
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return false, fmt.Errorf("can't create %s: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		netlink.LinkDel(link)
+		return false, fmt.Errorf("can't set %s up: %v", name, err)
+	}
+	return true, nil
+}
+
+// deleteVCan removes the vcan interface name
+func deleteVCan(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
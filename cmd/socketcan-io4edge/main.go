@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -8,13 +9,12 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/ci4rail/io4edge-client-go/canl2"
+	"github.com/ci4rail/socketcan-io4edge/internal/metrics"
 	"github.com/ci4rail/socketcan-io4edge/internal/version"
-	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"github.com/ci4rail/socketcan-io4edge/pkg/gateway"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-var verbose bool
-
 func main() {
 	flag.Usage = func() {
 		fmt.Printf("Usage: %s [OPTIONS] <io4edge-device-address> <socketcan-instance-name>\n", os.Args[0])
@@ -23,51 +23,93 @@ func main() {
 	}
 	showVersion := flag.Bool("version", false, "show version and exit")
 	verboseP := flag.Bool("v", false, "verbose")
+	fdMode := flag.Bool("fd", false, "enable CAN FD frames on socketcan interface")
+	filter := flag.String("filter", "", "comma separated socketcan receive filters in candump syntax (<id>:<mask>, <id>~<mask>). Only matching frames are sent to the io4edge device")
+	hwFilter := flag.String("hwfilter", "", "acceptance filter <code>:<mask> (hex) applied by the io4edge device. Only matching frames are streamed from the device")
+	bitRate := flag.Uint("bitrate", 0, "configure the io4edge CAN controller with this bitrate (bit/s). If 0, the device configuration is not changed")
+	samplePoint := flag.Float64("samplepoint", 0.8, "sample point (0.0-1.0), used with -bitrate")
+	sjw := flag.Uint("sjw", 1, "synchronization jump width (1-4), used with -bitrate")
+	listenOnly := flag.Bool("listenonly", false, "configure the io4edge CAN controller in listen only mode, used with -bitrate")
+	busOffRestart := flag.Duration("busoff-restart", 0, "restart the io4edge CAN controller after this delay when it is bus off (e.g. 100ms). 0: no automatic restart. Requires -bitrate")
+	txEcho := flag.Bool("echo", false, "write frames back to socketcan when the io4edge device accepted them for transmission. The socketcan interface must be one end of a vxcan pair, otherwise the gateway doesn't start")
+	txPolicy := flag.String("tx-policy", "fifo", "order of frames sent to the io4edge device: fifo or priority (lowest CAN ID first, frames with the same ID keep their order)")
+	txRateLimit := flag.String("tx-ratelimit", "", "comma separated minimum intervals between frames with the same ID sent to the io4edge device, <id>:<interval> (hex id, e.g. 100:10ms)")
+	tsLogPath := flag.String("tslog", "", "log frames from io4edge device with device receive timestamps (mapped to host time) to this file in candump log format")
+	metricsAddr := flag.String("metrics", "", "serve prometheus metrics on this address (e.g. :9100) under /metrics")
 	flag.Parse()
 	if *showVersion {
 		fmt.Printf("%s\n", version.Version)
 		os.Exit(0)
 	}
-	verbose = *verboseP
 
 	if flag.NArg() != 2 {
 		flag.Usage()
 		return
 	}
-	io4edgeAddress := flag.Arg(0)
-	socketCANInstance := flag.Arg(1)
-
-	fmt.Printf("io4edge-device-address: %s, socketcan-instance %s\n", io4edgeAddress, socketCANInstance)
-
-	socketCAN, err := socketcan.NewRawInterface(socketCANInstance)
+	cfg := gateway.Config{
+		Address:      flag.Arg(0),
+		Interface:    flag.Arg(1),
+		FDMode:       *fdMode,
+		TxEcho:       *txEcho,
+		TimestampLog: *tsLogPath,
+		Verbose:      *verboseP,
+	}
+	if *hwFilter != "" {
+		var err error
+		cfg.AcceptanceFilter, err = gateway.ParseAcceptanceFilter(*hwFilter)
+		if err != nil {
+			log.Fatalf("Invalid hardware filter: %v\n", err)
+		}
+	}
+	var err error
+	cfg.TxPolicy, err = gateway.ParseTxPolicy(*txPolicy)
 	if err != nil {
-		log.Fatalf("Error creating socketcan interface: %v\n", err)
-		os.Exit(1)
+		log.Fatalf("Invalid tx policy: %v\n", err)
+	}
+	if *txRateLimit != "" {
+		cfg.TxRateLimits, err = gateway.ParseTxRateLimits(*txRateLimit)
+		if err != nil {
+			log.Fatalf("Invalid tx rate limit: %v\n", err)
+		}
+	}
+	if *filter != "" {
+		cfg.Filters, err = gateway.ParseFilters(*filter)
+		if err != nil {
+			log.Fatalf("Invalid filter: %v\n", err)
+		}
 	}
-	defer socketCAN.Close()
+	if *bitRate != 0 {
+		cfg.Bus = &gateway.BusConfig{
+			BitRate:     uint32(*bitRate),
+			SamplePoint: float32(*samplePoint),
+			SJW:         uint8(*sjw),
+			ListenOnly:  *listenOnly,
+		}
+	}
+	cfg.BusOffRestart = *busOffRestart
 
-	io4edgeCANClient, err := canl2.NewClientFromUniversalAddress(io4edgeAddress, 0)
-	if err != nil {
-		log.Fatalf("Failed to create canl2 client: %v\n", err)
+	if *metricsAddr != "" {
+		cfg.Metrics = gateway.NewMetrics()
+		prometheus.MustRegister(cfg.Metrics)
+		metrics.Serve(*metricsAddr)
 	}
-	fmt.Printf("connected to io4edge CAN at %s\n", io4edgeAddress)
-	// start gateway
-	toSocketCAN(socketCAN, io4edgeCANClient)
-	fromSocketCAN(socketCAN, io4edgeCANClient)
 
-	waitForSignal()
-}
+	fmt.Printf("io4edge-device-address: %s, socketcan-instance %s\n", cfg.Address, cfg.Interface)
+
+	gw := gateway.New(cfg)
+	if err := gw.Start(context.Background()); err != nil {
+		log.Fatalf("%v\n", err)
+	}
 
-func waitForSignal() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigs
-	fmt.Println()
-	fmt.Println(sig)
-}
-
-func verbosePrint(format string, arg ...any) {
-	if verbose {
-		fmt.Printf(format, arg...)
+	select {
+	case sig := <-sigs:
+		fmt.Println()
+		fmt.Println(sig)
+		// stop the io4edge stream and close the socket
+		gw.Stop()
+	case <-gw.Done():
+		log.Fatalf("gateway terminated: %v\n", gw.Err())
 	}
 }
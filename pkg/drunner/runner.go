@@ -2,90 +2,354 @@ package drunner
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"os/exec"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// DefaultGracePeriod is the time Stop waits for the executable to terminate after SIGTERM before it is killed
+const DefaultGracePeriod = 5 * time.Second
+
+// State is the state of a runner
+type State int
+
+const (
+	// StateRunning means the executable is running
+	StateRunning State = iota
+	// StateBackingOff means the executable has terminated and waits for restart
+	StateBackingOff
+	// StateFailed means the executable terminated too often and is not restarted anymore
+	StateFailed
+	// StateStopped means the runner has been stopped
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateRunning:
+		return "running"
+	case StateBackingOff:
+		return "backing off"
+	case StateFailed:
+		return "failed"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// RestartPolicy defines how a terminated executable is restarted.
+type RestartPolicy struct {
+	// MinBackoff is the delay before the first restart. The delay is doubled with each restart up to MaxBackoff.
+	// If the executable ran for at least MaxBackoff, the delay is reset to MinBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter randomizes the delay by +/- Jitter * delay (0.0-1.0, larger values are treated as 1.0)
+	Jitter float64
+	// If the executable terminates more than MaxRestarts times within Window, the runner enters StateFailed.
+	// Every termination counts, also with exit code 0: the executable is expected to run until it is stopped.
+	// 0 means unlimited restarts.
+	MaxRestarts int
+	Window      time.Duration
+}
+
+// DefaultRestartPolicy restarts the executable forever with a backoff between 1s and 1min
+var DefaultRestartPolicy = RestartPolicy{
+	MinBackoff:  time.Second,
+	MaxBackoff:  time.Minute,
+	Jitter:      0.2,
+	MaxRestarts: 0,
+	Window:      5 * time.Minute,
+}
+
+// StateChangeFunc is called when the state of a runner changes
+type StateChangeFunc func(state State)
+
 // Runner is a runner object.
+// It starts an executable and restarts it when it terminates, until the runner is stopped.
 type Runner struct {
-	id           string
-	shallRestart bool
-	executable   string
-	args         []string
-	cmd          *exec.Cmd
+	id            string
+	executable    string
+	args          []string
+	gracePeriod   time.Duration
+	policy        RestartPolicy
+	onStateChange StateChangeFunc
+
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the supervisor has finished and no process is running
+
+	mu           sync.Mutex // protects state, restarts and lastExitCode
+	state        State
+	restarts     uint64
+	lastExitCode int
+}
+
+// process is a single run of the executable
+type process struct {
+	cmd      *exec.Cmd
+	pwStdout *io.PipeWriter
+	pwStderr *io.PipeWriter
 }
 
-// New starts the executable with the given arguments and returns a runner object.
-// The runner object can be used to stop the executable.
-// If the executable terminates, it is restarted again
+// New creates a runner for the executable with the given arguments.
+// The executable is started with Start.
 // stderr and stdout are captured and printed to stdout and stderr with the id as prefix.
-func New(id string, executable string, arg ...string) (*Runner, error) {
-	r := &Runner{
+func New(id string, executable string, arg ...string) *Runner {
+	return &Runner{
 		id:           id,
-		shallRestart: true,
 		executable:   executable,
 		args:         arg,
+		gracePeriod:  DefaultGracePeriod,
+		policy:       DefaultRestartPolicy,
+		state:        StateStopped,
+		lastExitCode: -1,
+	}
+}
+
+// SetGracePeriod sets the time the runner waits for the executable to terminate after SIGTERM before it is killed.
+// Must be called before Start.
+func (r *Runner) SetGracePeriod(d time.Duration) {
+	r.gracePeriod = d
+}
+
+// SetRestartPolicy sets the policy applied when the executable terminates.
+// Must be called before Start.
+func (r *Runner) SetRestartPolicy(p RestartPolicy) {
+	r.policy = p
+}
+
+// OnStateChange sets a function that is called on each state transition of the runner.
+// The function is called from the supervising go routine. Must be called before Start.
+func (r *Runner) OnStateChange(f StateChangeFunc) {
+	r.onStateChange = f
+}
+
+// Start starts the executable and supervises it in the background.
+// If the executable terminates, it is restarted according to the restart policy.
+// When ctx is cancelled, the executable is stopped: SIGTERM is sent to its process group and,
+// if it doesn't terminate within the grace period, SIGKILL.
+// Returns an error if the executable can't be started. A runner can be started only once.
+func (r *Runner) Start(ctx context.Context) error {
+	if r.done != nil {
+		return fmt.Errorf("%s: already started", r.id)
 	}
 	fmt.Printf("%s: starting process\n", r.id)
-	prStdout, prStderr, err := r.startup()
+	p, err := r.startup()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	go func() {
-		for {
-			r.captureOutput(prStdout, prStderr)
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	r.setState(StateRunning)
+	go r.supervise(ctx, p)
+	return nil
+}
 
-			// wait for executable to terminate
-			err = r.cmd.Wait()
-			if err != nil {
-				fmt.Printf("%s: process terminated with error: %v\n", r.id, err)
-			}
-			if !r.shallRestart {
-				break
-			}
-			fmt.Printf("%s: restarting process\n", r.id)
-			prStdout, prStderr, err = r.startup()
-			if err != nil {
-				fmt.Printf("%s: can't restart process: %v\n", r.id, err)
-				break
-			}
-		}
-	}()
-	return r, nil
+// Stop stops the runner and returns when the executable has terminated.
+// A runner in StateFailed keeps its state.
+func (r *Runner) Stop() error {
+	if r.done == nil {
+		return fmt.Errorf("%s: not started", r.id)
+	}
+	r.cancel()
+	r.Wait()
+	return nil
 }
 
-func (r *Runner) startup() (*io.PipeReader, *io.PipeReader, error) {
-	r.cmd = exec.Command(r.executable, r.args...)
-	//r.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	prStdout, pwStdout := io.Pipe()
-	r.cmd.Stdout = pwStdout
-	prStderr, pwStderr := io.Pipe()
-	r.cmd.Stderr = pwStderr
+// Done returns a channel that is closed when the runner has finished, i.e. it has been stopped or
+// has given up restarting, and the executable is not running.
+func (r *Runner) Done() <-chan struct{} {
+	return r.done
+}
 
-	err := r.cmd.Start()
-	if err != nil {
-		return nil, nil, fmt.Errorf("%s: can't start process: %v", r.id, err)
+// Wait blocks until the runner has finished.
+func (r *Runner) Wait() {
+	if r.done != nil {
+		<-r.done
 	}
-	return prStdout, prStderr, nil
 }
 
-// Stop stops the executable.
-// If the executable is not running or can't be stopped, it returns an error.
-// Restart is prohibited after Stop.
-func (r *Runner) Stop() error {
-	r.shallRestart = false
+// State returns the current state of the runner.
+func (r *Runner) State() State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
 
-	if r.cmd.Process != nil {
-		err := r.cmd.Process.Kill()
+// Restarts returns how often the executable has been restarted.
+func (r *Runner) Restarts() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.restarts
+}
+
+// LastExitCode returns the exit code of the last terminated process.
+// It is -1 if the process was terminated by a signal or no process has terminated yet.
+func (r *Runner) LastExitCode() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastExitCode
+}
+
+func (r *Runner) setState(s State) {
+	r.mu.Lock()
+	changed := r.state != s
+	r.state = s
+	r.mu.Unlock()
+
+	if changed && r.onStateChange != nil {
+		r.onStateChange(s)
+	}
+}
+
+// supervise waits for the executable to terminate and restarts it according to the restart policy.
+// It is the only go routine that accesses the running process.
+func (r *Runner) supervise(ctx context.Context, p *process) {
+	defer close(r.done)
+
+	var backoff time.Duration
+	terminations := []time.Time{}
+
+	for {
+		started := time.Now()
+		exited := make(chan error, 1)
+		go func(p *process) {
+			exited <- p.wait()
+		}(p)
+
+		var err error
+		select {
+		case err = <-exited:
+		case <-ctx.Done():
+			r.terminate(p, exited)
+			r.setState(StateStopped)
+			return
+		}
 		if err != nil {
-			return fmt.Errorf("%s: can't kill process: %v", r.id, err)
+			fmt.Printf("%s: process terminated with error: %v\n", r.id, err)
 		}
-	} else {
-		return fmt.Errorf("%s: process not running", r.id)
+		r.mu.Lock()
+		r.lastExitCode = p.cmd.ProcessState.ExitCode()
+		r.mu.Unlock()
+
+		now := time.Now()
+		if backoff == 0 || now.Sub(started) >= r.policy.MaxBackoff {
+			backoff = r.policy.MinBackoff
+		}
+		terminations = recentTerminations(append(terminations, now), now, r.policy.Window)
+		if r.policy.MaxRestarts > 0 && len(terminations) > r.policy.MaxRestarts {
+			fmt.Printf("%s: process terminated %d times within %v, giving up\n", r.id, len(terminations), r.policy.Window)
+			r.setState(StateFailed)
+			return
+		}
+
+		delay := jitter(backoff, r.policy.Jitter)
+		fmt.Printf("%s: restarting process in %v\n", r.id, delay)
+		r.setState(StateBackingOff)
+		select {
+		case <-ctx.Done():
+			r.setState(StateStopped)
+			return
+		case <-time.After(delay):
+		}
+		backoff *= 2
+		if backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+
+		r.mu.Lock()
+		r.restarts++
+		r.mu.Unlock()
+		p, err = r.startup()
+		if err != nil {
+			fmt.Printf("%s: can't restart process: %v\n", r.id, err)
+			r.setState(StateFailed)
+			return
+		}
+		r.setState(StateRunning)
 	}
-	return nil
+}
+
+// terminate stops the process group of p gracefully and waits until p has terminated.
+// exited receives the result of p.wait().
+func (r *Runner) terminate(p *process, exited chan error) {
+	pgid := p.cmd.Process.Pid
+
+	err := syscall.Kill(-pgid, syscall.SIGTERM)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		fmt.Printf("%s: can't terminate process: %v\n", r.id, err)
+	}
+	select {
+	case <-exited:
+		return
+	case <-time.After(r.gracePeriod):
+	}
+
+	fmt.Printf("%s: process did not terminate within %v, killing it\n", r.id, r.gracePeriod)
+	err = syscall.Kill(-pgid, syscall.SIGKILL)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		fmt.Printf("%s: can't kill process: %v\n", r.id, err)
+	}
+	<-exited
+}
+
+// recentTerminations returns the termination times that are within window before now
+func recentTerminations(terminations []time.Time, now time.Time, window time.Duration) []time.Time {
+	for len(terminations) > 0 && now.Sub(terminations[0]) > window {
+		terminations = terminations[1:]
+	}
+	return terminations
+}
+
+// jitter randomizes d by +/- factor * d. factor is clamped to 0.0-1.0, the result is never negative.
+func jitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	if factor > 1 {
+		factor = 1
+	}
+	j := d + time.Duration((rand.Float64()*2-1)*factor*float64(d))
+	if j < 0 {
+		return 0
+	}
+	return j
+}
+
+func (r *Runner) startup() (*process, error) {
+	cmd := exec.Command(r.executable, r.args...)
+	// run in own process group, so that all children of the process can be stopped
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	prStdout, pwStdout := io.Pipe()
+	cmd.Stdout = pwStdout
+	prStderr, pwStderr := io.Pipe()
+	cmd.Stderr = pwStderr
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't start process: %v", r.id, err)
+	}
+	r.captureOutput(prStdout, prStderr)
+	return &process{
+		cmd:      cmd,
+		pwStdout: pwStdout,
+		pwStderr: pwStderr,
+	}, nil
+}
+
+// wait waits for the process to terminate and closes the output pipes
+func (p *process) wait() error {
+	err := p.cmd.Wait()
+	p.pwStdout.Close()
+	p.pwStderr.Close()
+	return err
 }
 
 func (r *Runner) captureOutput(prStdout *io.PipeReader, prStderr *io.PipeReader) {
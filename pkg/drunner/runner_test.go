@@ -0,0 +1,94 @@
+package drunner
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStopTerminatesGracefully(t *testing.T) {
+	r := New("test", "/bin/sh", "-c", "sleep 10")
+	assert.Nil(t, r.Start(context.Background()))
+
+	start := time.Now()
+	assert.Nil(t, r.Stop())
+	assert.Less(t, time.Since(start), DefaultGracePeriod)
+	assert.Equal(t, StateStopped, r.State())
+}
+
+func TestStopKillsAfterGracePeriod(t *testing.T) {
+	r := New("test", "/bin/sh", "-c", "trap '' TERM; while true; do sleep 0.1; done")
+	r.SetGracePeriod(300 * time.Millisecond)
+	assert.Nil(t, r.Start(context.Background()))
+	time.Sleep(100 * time.Millisecond) // let the shell install the trap
+
+	start := time.Now()
+	assert.Nil(t, r.Stop())
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestCrashLoopEntersFailedState(t *testing.T) {
+	r := New("test", "/bin/sh", "-c", "exit 3")
+	r.SetRestartPolicy(RestartPolicy{
+		MinBackoff:  10 * time.Millisecond,
+		MaxBackoff:  40 * time.Millisecond,
+		MaxRestarts: 2,
+		Window:      time.Minute,
+	})
+	assert.Nil(t, r.Start(context.Background()))
+
+	select {
+	case <-r.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("runner did not give up")
+	}
+	assert.Equal(t, StateFailed, r.State())
+	assert.Equal(t, uint64(2), r.Restarts())
+	assert.Equal(t, 3, r.LastExitCode())
+
+	// Stop keeps the failed state
+	assert.Nil(t, r.Stop())
+	assert.Equal(t, StateFailed, r.State())
+}
+
+func TestJitter(t *testing.T) {
+	assert.Equal(t, time.Second, jitter(time.Second, 0))
+	assert.Equal(t, time.Second, jitter(time.Second, -1))
+	for i := 0; i < 1000; i++ {
+		d := jitter(time.Second, 0.2)
+		assert.GreaterOrEqual(t, d, 800*time.Millisecond)
+		assert.LessOrEqual(t, d, 1200*time.Millisecond)
+
+		// factors above 1 are clamped, the delay never becomes negative
+		d = jitter(time.Second, 5)
+		assert.GreaterOrEqual(t, d, time.Duration(0))
+		assert.LessOrEqual(t, d, 2*time.Second)
+	}
+}
+
+func TestCancelWhileBackingOff(t *testing.T) {
+	var mu sync.Mutex
+	states := []State{}
+
+	r := New("test", "/bin/sh", "-c", "exit 1")
+	r.SetRestartPolicy(RestartPolicy{MinBackoff: time.Hour, MaxBackoff: time.Hour})
+	r.OnStateChange(func(s State) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, s)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, r.Start(ctx))
+
+	assert.Eventually(t, func() bool { return r.State() == StateBackingOff }, 3*time.Second, 10*time.Millisecond)
+	cancel()
+	r.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []State{StateRunning, StateBackingOff, StateStopped}, states)
+	assert.Equal(t, uint64(0), r.Restarts())
+}
@@ -0,0 +1,58 @@
+package gateway
+
+import (
+	"fmt"
+
+	"github.com/ci4rail/io4edge-client-go/canl2"
+)
+
+// BusConfig contains the CAN controller settings of the io4edge device
+type BusConfig struct {
+	BitRate     uint32 // bit/s
+	SamplePoint float32
+	SJW         uint8
+	ListenOnly  bool
+}
+
+// configureBus uploads the bus configuration to the io4edge device and verifies it by reading it back.
+func configureBus(io4edgeCANClient *canl2.Client, cfg *BusConfig) error {
+	err := io4edgeCANClient.UploadConfiguration(
+		canl2.WithBitRate(cfg.BitRate),
+		canl2.WithSamplePoint(cfg.SamplePoint),
+		canl2.WithSJW(cfg.SJW),
+		canl2.WithListenOnly(cfg.ListenOnly),
+	)
+	if err != nil {
+		return fmt.Errorf("upload configuration failed: %v", err)
+	}
+
+	actual, err := io4edgeCANClient.DownloadConfiguration()
+	if err != nil {
+		return fmt.Errorf("download configuration failed: %v", err)
+	}
+	return verifyBusConfig(cfg, actual)
+}
+
+// verifyBusConfig checks whether the configuration read back from the device matches the wanted one.
+func verifyBusConfig(want *BusConfig, actual *canl2.Configuration) error {
+	if actual.BitRate != want.BitRate {
+		return fmt.Errorf("bitrate mismatch: want %d, device has %d", want.BitRate, actual.BitRate)
+	}
+	if actual.SJW != want.SJW {
+		return fmt.Errorf("sjw mismatch: want %d, device has %d", want.SJW, actual.SJW)
+	}
+	if actual.ListenOnly != want.ListenOnly {
+		return fmt.Errorf("listen only mismatch: want %v, device has %v", want.ListenOnly, actual.ListenOnly)
+	}
+	// canl2.DownloadConfiguration divides the device value (1/1000) by 1000 as integer, compare after the same truncation
+	if wantSP := float32(samplePointUnits(want.SamplePoint) / 1000); actual.SamplePoint != wantSP {
+		return fmt.Errorf("sample point mismatch: want %.3f (read back as %.0f), device has %.0f",
+			want.SamplePoint, wantSP, actual.SamplePoint)
+	}
+	return nil
+}
+
+// samplePointUnits converts the sample point into device units as canl2.WithSamplePoint does
+func samplePointUnits(sp float32) int32 {
+	return int32(sp * 1000)
+}
@@ -0,0 +1,24 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/ci4rail/io4edge-client-go/canl2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyBusConfig(t *testing.T) {
+	want := &BusConfig{BitRate: 250000, SamplePoint: 0.875, SJW: 2}
+
+	// canl2.DownloadConfiguration truncates 875 to 0
+	assert.Nil(t, verifyBusConfig(want, &canl2.Configuration{BitRate: 250000, SJW: 2}))
+	assert.NotNil(t, verifyBusConfig(want, &canl2.Configuration{BitRate: 250000, SJW: 2, SamplePoint: 1}))
+	assert.NotNil(t, verifyBusConfig(want, &canl2.Configuration{BitRate: 500000, SJW: 2}))
+	assert.NotNil(t, verifyBusConfig(want, &canl2.Configuration{BitRate: 250000, SJW: 1}))
+	assert.NotNil(t, verifyBusConfig(want, &canl2.Configuration{BitRate: 250000, SJW: 2, ListenOnly: true}))
+	assert.NotNil(t, verifyBusConfig(want, &canl2.Configuration{BitRate: 250000, SJW: 2, SamplePoint: 0.8}))
+
+	want.SamplePoint = 1
+	assert.Nil(t, verifyBusConfig(want, &canl2.Configuration{BitRate: 250000, SJW: 2, SamplePoint: 1}))
+	assert.NotNil(t, verifyBusConfig(want, &canl2.Configuration{BitRate: 250000, SJW: 2}))
+}
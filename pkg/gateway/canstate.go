@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	fspb "github.com/ci4rail/io4edge_api/canL2/go/canL2/v1alpha1"
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// canState is the state of a CAN controller as modelled by the Linux CAN drivers (enum can_state)
+type canState int
+
+const (
+	canStateErrorActive canState = iota
+	canStateErrorWarning
+	canStateErrorPassive
+	canStateBusOff
+)
+
+func (s canState) String() string {
+	switch s {
+	case canStateErrorActive:
+		return "error active"
+	case canStateErrorWarning:
+		return "error warning"
+	case canStateErrorPassive:
+		return "error passive"
+	case canStateBusOff:
+		return "bus off"
+	}
+	return "unknown"
+}
+
+// canStateFromIo4edge maps the io4edge controller state. The io4edge device reports no warning state.
+func canStateFromIo4edge(state fspb.ControllerState) canState {
+	switch state {
+	case fspb.ControllerState_CAN_ERROR_PASSIVE:
+		return canStateErrorPassive
+	case fspb.ControllerState_CAN_BUS_OFF:
+		return canStateBusOff
+	}
+	return canStateErrorActive
+}
+
+// errorCounters are the TX and RX error counters of a CAN controller
+type errorCounters struct {
+	tx uint8
+	rx uint8
+}
+
+// stateChangeErrorFrames returns the error frames a Linux CAN driver sends when the controller state changes
+// (see can_change_state and can_restart in drivers/net/can/dev):
+//   - warning and passive: CAN_ERR_CRTL with the TX/RX warning or passive flags
+//   - back to error active: CAN_ERR_CRTL with CAN_ERR_CRTL_ACTIVE
+//   - bus off: CAN_ERR_BUSOFF
+//   - leaving bus off: CAN_ERR_RESTARTED, followed by the frame for the new state if it is not error active
+//
+// If counters is not nil, the error counters are included in data[6]/data[7] (CAN_ERR_CNT) and only
+// the flags of the direction with the higher counter are set.
+func stateChangeErrorFrames(oldState canState, newState canState, counters *errorCounters) []*socketcan.CANErrorFrame {
+	if oldState == newState {
+		return nil
+	}
+	frames := []*socketcan.CANErrorFrame{}
+	if oldState == canStateBusOff {
+		frames = append(frames, &socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrRestarted})
+		if newState == canStateErrorActive {
+			return frames
+		}
+	}
+	if newState == canStateBusOff {
+		return append(frames, &socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrBusOff})
+	}
+
+	f := &socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrCtrl}
+	tx, rx := true, true
+	if counters != nil {
+		f.ErrorClass |= socketcan.CANErrCnt
+		f.TxErrorCounter = counters.tx
+		f.RxErrorCounter = counters.rx
+		tx = counters.tx >= counters.rx
+		rx = counters.rx >= counters.tx
+	}
+	switch newState {
+	case canStateErrorActive:
+		f.CANCtrlErrorDetails = socketcan.CANErrCtrlActive
+	case canStateErrorWarning:
+		if tx {
+			f.CANCtrlErrorDetails |= socketcan.CANErrCtrlTxWarning
+		}
+		if rx {
+			f.CANCtrlErrorDetails |= socketcan.CANErrCtrlRxWarning
+		}
+	case canStateErrorPassive:
+		if tx {
+			f.CANCtrlErrorDetails |= socketcan.CANErrCtrlTxPassive
+		}
+		if rx {
+			f.CANCtrlErrorDetails |= socketcan.CANErrCtrlRxPassive
+		}
+	}
+	return append(frames, f)
+}
@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateChangeErrorFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to canState
+		counters *errorCounters
+		want     []*socketcan.CANErrorFrame
+	}{
+		{"unchanged", canStateErrorActive, canStateErrorActive, nil, nil},
+		{"warning", canStateErrorActive, canStateErrorWarning, nil, []*socketcan.CANErrorFrame{
+			{ErrorClass: socketcan.CANErrCtrl, CANCtrlErrorDetails: socketcan.CANErrCtrlTxWarning | socketcan.CANErrCtrlRxWarning},
+		}},
+		{"passive with counters", canStateErrorWarning, canStateErrorPassive, &errorCounters{tx: 128, rx: 3}, []*socketcan.CANErrorFrame{
+			{ErrorClass: socketcan.CANErrCtrl | socketcan.CANErrCnt, CANCtrlErrorDetails: socketcan.CANErrCtrlTxPassive, TxErrorCounter: 128, RxErrorCounter: 3},
+		}},
+		{"active", canStateErrorPassive, canStateErrorActive, nil, []*socketcan.CANErrorFrame{
+			{ErrorClass: socketcan.CANErrCtrl, CANCtrlErrorDetails: socketcan.CANErrCtrlActive},
+		}},
+		{"bus off", canStateErrorPassive, canStateBusOff, nil, []*socketcan.CANErrorFrame{
+			{ErrorClass: socketcan.CANErrBusOff},
+		}},
+		{"restarted", canStateBusOff, canStateErrorActive, nil, []*socketcan.CANErrorFrame{
+			{ErrorClass: socketcan.CANErrRestarted},
+		}},
+		{"restarted to passive", canStateBusOff, canStateErrorPassive, nil, []*socketcan.CANErrorFrame{
+			{ErrorClass: socketcan.CANErrRestarted},
+			{ErrorClass: socketcan.CANErrCtrl, CANCtrlErrorDetails: socketcan.CANErrCtrlTxPassive | socketcan.CANErrCtrlRxPassive},
+		}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, stateChangeErrorFrames(tt.from, tt.to, tt.counters), tt.name)
+	}
+}
@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"time"
+)
+
+const (
+	// clock offsets are collected in intervals of this device time (µs). Only the minimum offset of each interval is kept,
+	// because it corresponds to the lowest transmission latency
+	clockIntervalUs = 1000000
+	// number of intervals used for offset and drift estimation
+	clockIntervals = 60
+)
+
+type clockPoint struct {
+	deviceUs  int64 // device time relative to refDeviceUs
+	offsetUs  int64 // host time - device time
+	intervals int64 // interval number
+}
+
+// clockMapper maps device timestamps (µs since device start) to host time.
+// It estimates offset and drift of the device clock from pairs of device delivery timestamps and host arrival times.
+type clockMapper struct {
+	valid       bool
+	refDeviceUs uint64
+	lastDevice  uint64
+	points      []clockPoint
+	// result of the estimation: host = device + offset + drift * device
+	offset float64
+	drift  float64
+}
+
+// update feeds a new pair of device time and host arrival time into the estimation
+func (m *clockMapper) update(deviceUs uint64, host time.Time) {
+	if m.valid && deviceUs < m.lastDevice {
+		// device restarted, forget history
+		*m = clockMapper{}
+	}
+	if !m.valid {
+		m.valid = true
+		m.refDeviceUs = deviceUs
+	}
+	m.lastDevice = deviceUs
+
+	d := int64(deviceUs - m.refDeviceUs)
+	p := clockPoint{
+		deviceUs:  d,
+		offsetUs:  host.UnixMicro() - d,
+		intervals: d / clockIntervalUs,
+	}
+
+	n := len(m.points)
+	if n > 0 && m.points[n-1].intervals == p.intervals {
+		if p.offsetUs < m.points[n-1].offsetUs {
+			m.points[n-1] = p
+		}
+	} else {
+		m.points = append(m.points, p)
+		if len(m.points) > clockIntervals {
+			m.points = m.points[1:]
+		}
+	}
+	m.estimate()
+}
+
+// estimate computes offset and drift by a least squares fit through the minimum offsets
+func (m *clockMapper) estimate() {
+	n := float64(len(m.points))
+	if len(m.points) < 2 {
+		m.offset = float64(m.points[0].offsetUs)
+		m.drift = 0
+		return
+	}
+	var sx, sy, sxx, sxy float64
+	for _, p := range m.points {
+		x := float64(p.deviceUs)
+		y := float64(p.offsetUs)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	den := n*sxx - sx*sx
+	if den == 0 {
+		m.offset = sy / n
+		m.drift = 0
+		return
+	}
+	m.drift = (n*sxy - sx*sy) / den
+	m.offset = (sy - m.drift*sx) / n
+}
+
+// toHost converts a device timestamp to host time. Returns the zero time if no estimation is available yet.
+func (m *clockMapper) toHost(deviceUs uint64) time.Time {
+	if !m.valid {
+		return time.Time{}
+	}
+	d := float64(int64(deviceUs - m.refDeviceUs))
+	hostUs := d + m.offset + m.drift*d
+	return time.UnixMicro(int64(hostUs))
+}
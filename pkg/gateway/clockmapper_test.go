@@ -0,0 +1,36 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockMapperOffsetAndDrift(t *testing.T) {
+	m := &clockMapper{}
+	assert.True(t, m.toHost(1000).IsZero())
+
+	hostStart := time.Unix(1600000000, 0)
+	deviceStart := uint64(5000000)
+
+	// device clock runs 100ppm slow, latency jitters between 1 and 7 ms
+	for i := 0; i < 1200; i++ {
+		deviceUs := deviceStart + uint64(i)*100000
+		hostUs := int64(float64(i*100000) * 1.0001)
+		latency := time.Duration(1000+(i%7)*1000) * time.Microsecond
+		m.update(deviceUs, hostStart.Add(time.Duration(hostUs)*time.Microsecond+latency))
+	}
+
+	deviceUs := deviceStart + 1000*100000
+	want := hostStart.Add(time.Duration(float64(1000*100000)*1.0001)*time.Microsecond + time.Millisecond)
+	assert.InDelta(t, 0, m.toHost(deviceUs).Sub(want).Microseconds(), 300)
+}
+
+func TestClockMapperDeviceRestart(t *testing.T) {
+	m := &clockMapper{}
+	host := time.Unix(1600000000, 0)
+	m.update(10000000, host)
+	m.update(1000, host.Add(time.Second))
+	assert.Equal(t, host.Add(time.Second), m.toHost(1000))
+}
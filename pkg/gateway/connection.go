@@ -0,0 +1,201 @@
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ci4rail/io4edge-client-go/canl2"
+	"github.com/ci4rail/io4edge-client-go/functionblock"
+)
+
+const (
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// connState is the state of the connection to the io4edge device
+type connState int
+
+const (
+	connDisconnected connState = iota
+	connConnecting
+	connStreaming
+	connBackoff
+)
+
+func (s connState) String() string {
+	switch s {
+	case connDisconnected:
+		return "disconnected"
+	case connConnecting:
+		return "connecting"
+	case connStreaming:
+		return "streaming"
+	case connBackoff:
+		return "backing off"
+	}
+	return "unknown"
+}
+
+// io4edgeConnection manages the connection to the io4edge device.
+// If the stream is lost, the client is re-created and the stream is restarted.
+type io4edgeConnection struct {
+	address     string
+	busCfg      *BusConfig // nil: don't configure the CAN controller
+	filter      AcceptanceFilter
+	log         *logger
+	onReconnect func() // called on each reconnect, may be nil
+
+	mu       sync.Mutex // protects client, state and closed
+	client   *canl2.Client
+	state    connState
+	closed   bool
+	closedCh chan struct{} // closed by close
+}
+
+func newIo4edgeConnection(address string, busCfg *BusConfig, filter AcceptanceFilter, log *logger) *io4edgeConnection {
+	return &io4edgeConnection{
+		address:  address,
+		busCfg:   busCfg,
+		filter:   filter,
+		log:      log,
+		closedCh: make(chan struct{}),
+	}
+}
+
+// connect creates the canl2 client, configures the CAN controller (if requested) and starts the stream.
+func (c *io4edgeConnection) connect() error {
+	c.setState(connConnecting)
+
+	client, err := canl2.NewClientFromUniversalAddress(c.address, 0)
+	if err != nil {
+		c.setState(connDisconnected)
+		return fmt.Errorf("failed to create canl2 client: %v", err)
+	}
+	c.log.printf("connected to io4edge CAN at %s\n", c.address)
+
+	if c.busCfg != nil {
+		if err := configureBus(client, c.busCfg); err != nil {
+			client.Close()
+			c.setState(connDisconnected)
+			return fmt.Errorf("failed to configure io4edge CAN: %v", err)
+		}
+		c.log.printf("configured io4edge CAN: bitrate %d, sample point %.3f, sjw %d, listen only %v\n",
+			c.busCfg.BitRate, c.busCfg.SamplePoint, c.busCfg.SJW, c.busCfg.ListenOnly)
+	}
+
+	err = client.StartStream(
+		canl2.WithFBStreamOption(functionblock.WithBucketSamples(bucketSamples)),
+		canl2.WithFBStreamOption(functionblock.WithBufferedSamples(bufferedSamples)),
+		canl2.WithFBStreamOption(functionblock.WithKeepaliveInterval(streamKeepAliveMs)),
+		canl2.WithFBStreamOption(functionblock.WithLowLatencyMode(true)),
+		canl2.WithFilter(c.filter.Code, c.filter.Mask))
+	if err != nil {
+		client.Close()
+		c.setState(connDisconnected)
+		return fmt.Errorf("StartStream failed: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		client.Close()
+		return fmt.Errorf("connection closed")
+	}
+	c.client = client
+	c.state = connStreaming
+	return nil
+}
+
+// reconnect closes the current client and tries to connect again with exponential backoff.
+// It returns when the stream is running again or the connection has been closed.
+func (c *io4edgeConnection) reconnect() {
+	if c.onReconnect != nil {
+		c.onReconnect()
+	}
+	c.mu.Lock()
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+	c.mu.Unlock()
+
+	backoff := reconnectMinBackoff
+	for !c.isClosed() {
+		err := c.connect()
+		if err == nil {
+			return
+		}
+		c.log.printf("reconnect to %s failed: %v, retry in %v\n", c.address, err, backoff)
+		c.setState(connBackoff)
+		select {
+		case <-c.closedCh:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// restartController re-applies the bus configuration, which re-initializes the CAN controller of the device
+func (c *io4edgeConnection) restartController() error {
+	client := c.getClient()
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+	if c.busCfg == nil {
+		return fmt.Errorf("no bus configuration")
+	}
+	return configureBus(client, c.busCfg)
+}
+
+// close stops the stream and closes the connection to the device. No reconnect is done afterwards.
+func (c *io4edgeConnection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.closedCh)
+	}
+	if c.client != nil {
+		if err := c.client.StopStream(); err != nil {
+			c.log.printf("StopStream failed: %v\n", err)
+		}
+		c.client.Close()
+		c.client = nil
+	}
+	c.state = connDisconnected
+}
+
+// isClosed returns true if close has been called
+func (c *io4edgeConnection) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// getClient returns the current canl2 client or nil if not connected
+func (c *io4edgeConnection) getClient() *canl2.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+func (c *io4edgeConnection) getState() connState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *io4edgeConnection) setState(s connState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s != c.state {
+		c.log.verbosef("io4edge connection state %v -> %v\n", c.state, s)
+	}
+	c.state = s
+}
@@ -0,0 +1,45 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// FrameEndpoint is one side of a gateway, e.g. a socketcan interface or an io4edge device.
+type FrameEndpoint interface {
+	// Send sends a batch of frames
+	Send(frames []*socketcan.CANFrame) error
+	// SendErrorFrame sends an error frame. Endpoints that can't represent error frames ignore it
+	SendErrorFrame(f *socketcan.CANErrorFrame) error
+	// Receive blocks until at least one event is available and returns the available events in the order
+	// they occurred, i.e. the received frames and the errors detected by the endpoint as error frames.
+	// Returns ctx.Err() if ctx is cancelled and ErrEndpointClosed if the endpoint has been closed
+	Receive(ctx context.Context) ([]Event, error)
+	// Close closes the endpoint
+	Close() error
+}
+
+// Event is a frame received by an endpoint or an error detected by the endpoint. Exactly one field is set.
+type Event struct {
+	Frame      *socketcan.CANFrame
+	ErrorFrame *socketcan.CANErrorFrame
+}
+
+// frameEvents returns the frames as events
+func frameEvents(frames []*socketcan.CANFrame) []Event {
+	events := make([]Event, len(frames))
+	for n, f := range frames {
+		events[n].Frame = f
+	}
+	return events
+}
+
+var (
+	// ErrEndpointClosed is returned by Receive if the endpoint has been closed
+	ErrEndpointClosed = errors.New("endpoint closed")
+	// ErrTxQueueFull is returned (wrapped) by Send if the frames were rejected because the transmit queue is full.
+	// Sending can be retried later
+	ErrTxQueueFull = errors.New("transmit queue full")
+)
@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// frameLogger writes the frames received from the io4edge device in candump log file format (candump -l).
+// The timestamps are the device receive timestamps, mapped to host time.
+type frameLogger struct {
+	file   *os.File
+	w      *bufio.Writer
+	ifName string
+}
+
+func newFrameLogger(path string, ifName string) (*frameLogger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &frameLogger{
+		file:   file,
+		w:      bufio.NewWriter(file),
+		ifName: ifName,
+	}, nil
+}
+
+// log writes a single frame to the log
+func (l *frameLogger) log(ts time.Time, f *socketcan.CANFrame) {
+	fmt.Fprintf(l.w, "(%d.%06d) %s %s\n", ts.Unix(), ts.Nanosecond()/1000, l.ifName, candumpFrameString(f))
+}
+
+// flush writes buffered log lines to the file
+func (l *frameLogger) flush() {
+	if err := l.w.Flush(); err != nil {
+		fmt.Printf("Error writing timestamp log: %v\n", err)
+	}
+}
+
+func (l *frameLogger) close() error {
+	l.flush()
+	return l.file.Close()
+}
+
+// candumpFrameString formats f in the candump/cansend notation, e.g. 123#DEADBEEF
+func candumpFrameString(f *socketcan.CANFrame) string {
+	var sb strings.Builder
+
+	if f.Extended {
+		fmt.Fprintf(&sb, "%08X#", f.ID)
+	} else {
+		fmt.Fprintf(&sb, "%03X#", f.ID)
+	}
+	if f.FD {
+		var flags int
+		if f.BRS {
+			flags |= 1
+		}
+		if f.ESI {
+			flags |= 2
+		}
+		fmt.Fprintf(&sb, "#%X", flags)
+	} else if f.RTR {
+		sb.WriteString("R")
+		return sb.String()
+	}
+	for i := 0; i < int(f.DLC) && i < len(f.Data); i++ {
+		fmt.Fprintf(&sb, "%02X", f.Data[i])
+	}
+	return sb.String()
+}
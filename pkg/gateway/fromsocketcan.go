@@ -0,0 +1,212 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+const (
+	maxFramesPerIo4EdgeCANSend = 30
+	// maxTxPending is the maximum number of frames in the tx scheduler
+	maxTxPending = 128
+	// DefaultTxRetryBudget is the default for Config.TxRetryBudget
+	DefaultTxRetryBudget = time.Second
+	txRetryMinDelay      = 2 * time.Millisecond
+	txRetryMaxDelay      = 100 * time.Millisecond
+)
+
+// fromSocketCAN starts the gateway from the socketcan endpoint to the io4edge endpoint.
+// Frames are collected and sent in batches of up to maxFramesPerIo4EdgeCANSend frames.
+// While the writer retries a batch, frameQ fills up and the reader stops reading from socketcan (backpressure).
+// Frames that can't be sent are dropped and reported to socketcan with a CANErrCtrlTxOverflow error frame.
+func (g *Gateway) fromSocketCAN(ctx context.Context) {
+	// create a queue to buffer the received CAN frames from socketcan
+	frameQ := make(chan *socketcan.CANFrame, 128)
+	vcan := g.cfg.Interface
+
+	// Go routine to read from socketcan
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		for {
+			events, err := g.socketCAN.Receive(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				g.log.printf("Error reading from socketcan: %v\n", err)
+				g.fail(fmt.Errorf("error reading from socketcan: %v", err))
+				return
+			}
+			for _, ev := range events {
+				if ev.ErrorFrame != nil {
+					if err := g.io4edge.SendErrorFrame(ev.ErrorFrame); err != nil {
+						g.log.printf("Error writing error frame: %v\n", err)
+					}
+					continue
+				}
+				f := ev.Frame
+				g.log.verbosef("received %s\n", f.String())
+				select {
+				case frameQ <- f:
+					continue
+				default:
+				}
+				g.log.verbosef("queue to io4edge device full, waiting\n")
+				select {
+				case frameQ <- f:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	// Go routine to write to io4edge device
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		sched := newTxScheduler(g.cfg.TxPolicy, g.cfg.TxRateLimits)
+		for {
+			txFrames := nextTxFrames(ctx, frameQ, sched)
+			if txFrames == nil {
+				return
+			}
+			g.cfg.Metrics.setQueueDepth(vcan, dirFromSocketCAN, len(frameQ)+sched.len())
+			g.log.verbosef("Sending %d frames to io4edge device\n", len(txFrames))
+
+			// frames are dropped if the device is not ready, i.e. because it is bus off or reconnecting,
+			// or if its queue stays full
+			if err := g.sendWithRetry(ctx, txFrames); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				g.log.printf("Error sending %d frames to io4edge device, dropping them: %v\n", len(txFrames), err)
+				g.countSendFailure()
+				g.dropFrames(len(txFrames))
+				continue
+			}
+			for _, f := range txFrames {
+				atomic.AddUint64(&g.framesFromSocketCAN, 1)
+				g.cfg.Metrics.countFrame(vcan, dirFromSocketCAN, int(f.DLC))
+			}
+			if g.cfg.TxEcho {
+				// the device has no per frame confirmation, the frames are echoed when they are in its transmit queue.
+				// Later failures are reported as error frames, see echoLost.
+				atomic.StoreInt32(&g.echoPending, 1)
+				if err := g.socketCAN.Send(txFrames); err != nil {
+					g.log.printf("Error echoing frames to socketcan: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// sendWithRetry sends frames to the io4edge endpoint. If the frames are rejected because the transmit queue
+// is full, sending is retried with exponential backoff until the retry budget is exhausted.
+func (g *Gateway) sendWithRetry(ctx context.Context, frames []*socketcan.CANFrame) error {
+	budget := g.cfg.TxRetryBudget
+	if budget == 0 {
+		budget = DefaultTxRetryBudget
+	}
+	deadline := time.Now().Add(budget)
+	delay := txRetryMinDelay
+	for {
+		err := g.io4edge.Send(frames)
+		if err == nil || !errors.Is(err, ErrTxQueueFull) || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		atomic.AddUint64(&g.txRetries, 1)
+		g.cfg.Metrics.txRetriesTotal.WithLabelValues(g.cfg.Interface).Inc()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+		if delay > txRetryMaxDelay {
+			delay = txRetryMaxDelay
+		}
+	}
+}
+
+// echoLost returns a CAN_ERR_TX_TIMEOUT error frame if f reports that the transmit queue of the io4edge device
+// has been lost (bus off, stream restarted) after frames have been echoed, i.e. they may not have been transmitted.
+// Failures of single frames are reported by the device and forwarded as CAN_ERR_TX_TIMEOUT already.
+func (g *Gateway) echoLost(f *socketcan.CANErrorFrame) *socketcan.CANErrorFrame {
+	if !g.cfg.TxEcho || f.ErrorClass&(socketcan.CANErrBusOff|socketcan.CANErrRestarted) == 0 {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&g.echoPending, 1, 0) {
+		return nil
+	}
+	return &socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrTxTimeout}
+}
+
+// dropFrames counts dropped frames and reports them to socketcan
+func (g *Gateway) dropFrames(n int) {
+	atomic.AddUint64(&g.txDropped, uint64(n))
+	g.cfg.Metrics.txDroppedTotal.WithLabelValues(g.cfg.Interface).Add(float64(n))
+	err := g.socketCAN.SendErrorFrame(&socketcan.CANErrorFrame{
+		ErrorClass:          socketcan.CANErrCtrl,
+		CANCtrlErrorDetails: socketcan.CANErrCtrlTxOverflow,
+	})
+	if err != nil {
+		g.log.printf("Error writing error frame to socketcan: %v\n", err)
+	}
+}
+
+func (g *Gateway) countSendFailure() {
+	atomic.AddUint64(&g.sendFailures, 1)
+	g.cfg.Metrics.sendFailuresTotal.WithLabelValues(g.cfg.Interface).Inc()
+}
+
+// nextTxFrames moves the frames from frameQ to the scheduler and returns the next frames to send.
+// It waits until at least one frame may be sent. Returns nil if ctx is cancelled.
+func nextTxFrames(ctx context.Context, frameQ chan *socketcan.CANFrame, sched *txScheduler) []*socketcan.CANFrame {
+	for {
+		// read all waiting frames, but non-blocking
+	drain:
+		for sched.len() < maxTxPending {
+			select {
+			case f := <-frameQ:
+				sched.push(f)
+			default: // queue is empty
+				break drain
+			}
+		}
+		frames, wait := sched.next(time.Now(), maxFramesPerIo4EdgeCANSend)
+		if len(frames) > 0 {
+			return frames
+		}
+
+		// wait for new frames or until a rate limited frame may be sent
+		var q chan *socketcan.CANFrame
+		if sched.len() < maxTxPending {
+			q = frameQ
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case f := <-q:
+			sched.push(f)
+		case <-timeout:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package gateway connects an io4edge CANL2 function block with a socketcan interface.
+// All frames from the io4edge device are sent to socketcan and vice versa.
+//
+// Both sides are FrameEndpoints. New creates the io4edge and socketcan endpoints from the configuration,
+// NewWithEndpoints bridges any two endpoints, e.g. in-memory endpoints in tests.
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fspb "github.com/ci4rail/io4edge_api/canL2/go/canL2/v1alpha1"
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// Config is the configuration of a gateway
+type Config struct {
+	// Address of the io4edge device, either ip:port or the mdns instance name
+	Address string
+	// Interface is the name of the socketcan interface
+	Interface string
+	// FDMode enables CAN FD frames on the socketcan interface
+	FDMode bool
+	// Filters are the socketcan receive filters. If nil, all frames are sent to the io4edge device
+	Filters []socketcan.CANFilter
+	// AcceptanceFilter is the filter applied by the io4edge device on the stream
+	AcceptanceFilter AcceptanceFilter
+	// Bus is the CAN controller configuration. If nil, the device configuration is not changed
+	Bus *BusConfig
+	// BusOffRestart is the delay after which a CAN controller in bus off state is restarted by applying Bus again.
+	// 0: no automatic restart. Requires Bus
+	BusOffRestart time.Duration
+	// TxEcho writes frames from socketcan back to socketcan after the io4edge device accepted them for transmission.
+	// Transmit failures reported later are forwarded as CAN_ERR_TX_TIMEOUT error frames.
+	// Interface must be one end of a vxcan pair, the applications use the peer, which has no local echo.
+	// Start fails if Interface is not a vxcan interface.
+	TxEcho bool
+	// TxPolicy defines the order in which frames from socketcan are sent to the io4edge device
+	TxPolicy TxPolicy
+	// TxRateLimits is the minimum interval between two frames with the same ID, per ID.
+	// Standard and extended frames with the same numeric ID share a limit
+	TxRateLimits map[uint32]time.Duration
+	// TxRetryBudget is the maximum time to retry sending frames the io4edge device rejected because its
+	// transmit queue was full. 0: DefaultTxRetryBudget. Negative: no retries
+	TxRetryBudget time.Duration
+	// TimestampLog is the path of the candump log file for frames with device timestamps. Empty: no log
+	TimestampLog string
+	// Metrics receives the metrics of the gateway. If nil, the gateway uses unregistered metrics
+	Metrics *Metrics
+	// LogPrefix is prepended to all messages of the gateway
+	LogPrefix string
+	// Verbose enables verbose messages
+	Verbose bool
+}
+
+// Status describes the current state of a gateway
+type Status struct {
+	Connection          string
+	ControllerState     fspb.ControllerState
+	FramesToSocketCAN   uint64
+	FramesFromSocketCAN uint64
+	SendFailures        uint64
+	Reconnects          uint64
+	TxRetries           uint64
+	TxDropped           uint64
+}
+
+// Gateway connects an io4edge device with a socketcan interface
+type Gateway struct {
+	cfg       Config
+	log       *logger
+	io4edge   FrameEndpoint
+	socketCAN FrameEndpoint
+	io4eEp    *Io4edgeEndpoint // io4edge endpoint if it is an *Io4edgeEndpoint, for Status
+	tsLog     *frameLogger
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	done      chan struct{}
+
+	mu  sync.Mutex // protects err
+	err error
+
+	framesToSocketCAN   uint64
+	framesFromSocketCAN uint64
+	sendFailures        uint64
+	txRetries           uint64
+	txDropped           uint64
+	echoPending         int32 // 1 if frames have been echoed since the last reported loss of the device's transmit queue
+}
+
+// New creates a new gateway with the given configuration. The gateway is started with Start.
+func New(cfg Config) *Gateway {
+	if cfg.Metrics == nil {
+		cfg.Metrics = NewMetrics()
+	}
+	return &Gateway{
+		cfg: cfg,
+		log: newLogger(cfg),
+	}
+}
+
+// NewWithEndpoints creates a new gateway that bridges the given endpoints. The gateway is started with Start.
+// From cfg, only Interface (metrics label), Metrics, TimestampLog, LogPrefix and Verbose are used.
+// The endpoints are closed when the gateway terminates.
+func NewWithEndpoints(cfg Config, io4edge FrameEndpoint, socketCAN FrameEndpoint) *Gateway {
+	g := New(cfg)
+	g.io4edge = io4edge
+	g.socketCAN = socketCAN
+	if ep, ok := io4edge.(*Io4edgeEndpoint); ok {
+		g.io4eEp = ep
+	}
+	return g
+}
+
+// Start opens the socketcan interface and connects to the io4edge device, unless the endpoints have been passed
+// to NewWithEndpoints, and starts the gateway in the background.
+// The gateway runs until ctx is cancelled, Stop is called or a fatal error occurs.
+func (g *Gateway) Start(ctx context.Context) error {
+	if g.done != nil {
+		return fmt.Errorf("gateway already started")
+	}
+	if err := g.openEndpoints(); err != nil {
+		return err
+	}
+
+	if g.cfg.TimestampLog != "" {
+		var err error
+		g.tsLog, err = newFrameLogger(g.cfg.TimestampLog, g.cfg.Interface)
+		if err != nil {
+			g.closeEndpoints()
+			return fmt.Errorf("error creating timestamp log: %v", err)
+		}
+	}
+	g.done = make(chan struct{})
+
+	ctx, g.cancel = context.WithCancel(ctx)
+	g.toSocketCAN(ctx)
+	g.fromSocketCAN(ctx)
+
+	go func() {
+		<-ctx.Done()
+		g.wg.Wait()
+		g.closeEndpoints()
+		if g.tsLog != nil {
+			g.tsLog.close()
+		}
+		g.cfg.Metrics.deleteMetrics(g.cfg.Interface)
+		close(g.done)
+	}()
+	return nil
+}
+
+// openEndpoints creates the endpoints that have not been passed to NewWithEndpoints
+func (g *Gateway) openEndpoints() error {
+	if g.socketCAN == nil {
+		ep, err := NewSocketCANEndpoint(g.cfg)
+		if err != nil {
+			return err
+		}
+		g.socketCAN = ep
+	}
+	if g.io4edge == nil {
+		ep, err := NewIo4edgeEndpoint(g.cfg)
+		if err != nil {
+			g.socketCAN.Close()
+			return err
+		}
+		g.io4edge = ep
+		g.io4eEp = ep
+	}
+	return nil
+}
+
+func (g *Gateway) closeEndpoints() {
+	if err := g.io4edge.Close(); err != nil {
+		g.log.printf("Error closing io4edge endpoint: %v\n", err)
+	}
+	if err := g.socketCAN.Close(); err != nil {
+		g.log.printf("Error closing socketcan endpoint: %v\n", err)
+	}
+}
+
+// Stop stops the gateway and returns when all resources are released.
+func (g *Gateway) Stop() {
+	if g.done == nil {
+		return
+	}
+	g.cancel()
+	<-g.done
+}
+
+// Done returns a channel that is closed when the gateway has terminated, either by Stop or a fatal error.
+func (g *Gateway) Done() <-chan struct{} {
+	return g.done
+}
+
+// Err returns the fatal error that terminated the gateway, or nil.
+func (g *Gateway) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// Status returns the current status of the gateway.
+// Connection, ControllerState and Reconnects are only available if the io4edge endpoint is an *Io4edgeEndpoint.
+func (g *Gateway) Status() Status {
+	st := Status{
+		Connection:          connDisconnected.String(),
+		ControllerState:     fspb.ControllerState_CAN_OK,
+		FramesToSocketCAN:   atomic.LoadUint64(&g.framesToSocketCAN),
+		FramesFromSocketCAN: atomic.LoadUint64(&g.framesFromSocketCAN),
+		SendFailures:        atomic.LoadUint64(&g.sendFailures),
+		TxRetries:           atomic.LoadUint64(&g.txRetries),
+		TxDropped:           atomic.LoadUint64(&g.txDropped),
+	}
+	if g.io4eEp != nil {
+		st.Connection = g.io4eEp.ConnectionState()
+		st.ControllerState = g.io4eEp.ControllerState()
+		st.Reconnects = g.io4eEp.Reconnects()
+	}
+	return st
+}
+
+// fail terminates the gateway because of a fatal error
+func (g *Gateway) fail(err error) {
+	g.mu.Lock()
+	if g.err == nil {
+		g.err = err
+	}
+	g.mu.Unlock()
+	g.cancel()
+}
+
+// logger prints messages with a prefix
+type logger struct {
+	prefix  string
+	verbose bool
+}
+
+func newLogger(cfg Config) *logger {
+	return &logger{prefix: cfg.LogPrefix, verbose: cfg.Verbose}
+}
+
+func (l *logger) printf(format string, arg ...any) {
+	fmt.Printf(l.prefix+format, arg...)
+}
+
+func (l *logger) verbosef(format string, arg ...any) {
+	if l.verbose {
+		fmt.Printf(l.prefix+format, arg...)
+	}
+}
@@ -0,0 +1,257 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// memEndpoint is an in-memory FrameEndpoint
+type memEndpoint struct {
+	rx       chan Event    // events returned by Receive
+	rxErr    chan error    // errors returned by Receive
+	sendGate chan struct{} // if not nil, Send waits until it is closed
+
+	mu           sync.Mutex
+	receiveCalls int
+	sendCalls    int
+	sent         []*socketcan.CANFrame
+	sentErrors   []*socketcan.CANErrorFrame
+	sequence     []string // "frame" and "error" in the order of Send and SendErrorFrame
+	closed       bool
+}
+
+func newMemEndpoint() *memEndpoint {
+	return &memEndpoint{
+		rx:    make(chan Event, 16),
+		rxErr: make(chan error, 1),
+	}
+}
+
+func (e *memEndpoint) Send(frames []*socketcan.CANFrame) error {
+	e.mu.Lock()
+	e.sendCalls++
+	e.mu.Unlock()
+	if e.sendGate != nil {
+		<-e.sendGate
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sent = append(e.sent, frames...)
+	for range frames {
+		e.sequence = append(e.sequence, "frame")
+	}
+	return nil
+}
+
+func (e *memEndpoint) SendErrorFrame(f *socketcan.CANErrorFrame) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sentErrors = append(e.sentErrors, f)
+	e.sequence = append(e.sequence, "error")
+	return nil
+}
+
+func (e *memEndpoint) Receive(ctx context.Context) ([]Event, error) {
+	e.mu.Lock()
+	e.receiveCalls++
+	e.mu.Unlock()
+	select {
+	case ev := <-e.rx:
+		return []Event{ev}, nil
+	case err := <-e.rxErr:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (e *memEndpoint) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	return nil
+}
+
+func (e *memEndpoint) sentFrames() []*socketcan.CANFrame {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*socketcan.CANFrame{}, e.sent...)
+}
+
+func (e *memEndpoint) sentErrorFrames() []*socketcan.CANErrorFrame {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*socketcan.CANErrorFrame{}, e.sentErrors...)
+}
+
+func (e *memEndpoint) numSendCalls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.sendCalls
+}
+
+// numReceiveCalls returns how often Receive has been called. Receive is called again after the caller
+// processed the previous event.
+func (e *memEndpoint) numReceiveCalls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.receiveCalls
+}
+
+func (e *memEndpoint) isClosed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closed
+}
+
+func TestParseFilters(t *testing.T) {
+	filters, err := ParseFilters("123:7FF,00000200~1FFFFF00")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(filters))
+
+	// error frames aren't forwarded, so an error mask is rejected, also without data filters
+	_, err = ParseFilters("123:7FF,#4")
+	assert.NotNil(t, err)
+	_, err = ParseFilters("#4")
+	assert.NotNil(t, err)
+
+	// no data filters: all frames are forwarded
+	filters, err = ParseFilters(",")
+	assert.Nil(t, err)
+	assert.Nil(t, filters)
+}
+
+func TestGatewayBridgesEndpoints(t *testing.T) {
+	dev := newMemEndpoint()
+	bus := newMemEndpoint()
+	g := NewWithEndpoints(Config{Interface: "memtest0"}, dev, bus)
+	assert.Nil(t, g.Start(context.Background()))
+
+	toBus := &socketcan.CANFrame{ID: 0x123, DLC: 2, Data: []byte{1, 2}}
+	toDev := &socketcan.CANFrame{ID: 0x12345678, DLC: 1, Data: []byte{3}, Extended: true}
+	errFrame := &socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrBusOff}
+	dev.rx <- Event{Frame: toBus}
+	bus.rx <- Event{Frame: toDev}
+	dev.rx <- Event{ErrorFrame: errFrame}
+
+	assert.Eventually(t, func() bool {
+		return len(bus.sentFrames()) == 1 && len(dev.sentFrames()) == 1 && len(bus.sentErrorFrames()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, toBus, bus.sentFrames()[0])
+	assert.Equal(t, toDev, dev.sentFrames()[0])
+	assert.Equal(t, errFrame, bus.sentErrorFrames()[0])
+
+	st := g.Status()
+	assert.Equal(t, uint64(1), st.FramesToSocketCAN)
+	assert.Equal(t, uint64(1), st.FramesFromSocketCAN)
+
+	g.Stop()
+	assert.Nil(t, g.Err())
+	assert.True(t, dev.isClosed())
+	assert.True(t, bus.isClosed())
+}
+
+func TestGatewayKeepsErrorFrameOrder(t *testing.T) {
+	dev := newMemEndpoint()
+	bus := newMemEndpoint()
+	g := NewWithEndpoints(Config{Interface: "memtest4"}, dev, bus)
+	assert.Nil(t, g.Start(context.Background()))
+	defer g.Stop()
+
+	dev.rx <- Event{Frame: &socketcan.CANFrame{ID: 0x1}}
+	dev.rx <- Event{ErrorFrame: &socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrBusOff}}
+	dev.rx <- Event{Frame: &socketcan.CANFrame{ID: 0x2}}
+	dev.rx <- Event{ErrorFrame: &socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrRestarted}}
+	assert.Eventually(t, func() bool {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		return len(bus.sequence) == 4
+	}, time.Second, 10*time.Millisecond)
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	assert.Equal(t, []string{"frame", "error", "frame", "error"}, bus.sequence)
+}
+
+func TestGatewayEchoesTransmittedFrames(t *testing.T) {
+	dev := newMemEndpoint()
+	bus := newMemEndpoint()
+	g := NewWithEndpoints(Config{Interface: "memtest2", TxEcho: true}, dev, bus)
+	assert.Nil(t, g.Start(context.Background()))
+	defer g.Stop()
+
+	f := &socketcan.CANFrame{ID: 0x321, DLC: 1, Data: []byte{7}}
+	bus.rx <- Event{Frame: f}
+	assert.Eventually(t, func() bool { return len(bus.sentFrames()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, f, bus.sentFrames()[0])
+	assert.Equal(t, f, dev.sentFrames()[0])
+}
+
+func TestGatewayReportsLostEchoedFrames(t *testing.T) {
+	dev := newMemEndpoint()
+	bus := newMemEndpoint()
+	g := NewWithEndpoints(Config{Interface: "memtest3", TxEcho: true}, dev, bus)
+	assert.Nil(t, g.Start(context.Background()))
+	defer g.Stop()
+
+	bus.rx <- Event{Frame: &socketcan.CANFrame{ID: 0x321, DLC: 1, Data: []byte{7}}}
+	assert.Eventually(t, func() bool { return len(bus.sentFrames()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// bus off after the echo: the frame may not have been transmitted
+	dev.rx <- Event{ErrorFrame: &socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrBusOff}}
+	dev.rx <- Event{ErrorFrame: &socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrRestarted}}
+	assert.Eventually(t, func() bool { return len(bus.sentErrorFrames()) == 3 }, time.Second, 10*time.Millisecond)
+	errFrames := bus.sentErrorFrames()
+	assert.Equal(t, socketcan.CANErrBusOff, errFrames[0].ErrorClass)
+	assert.Equal(t, socketcan.CANErrTxTimeout, errFrames[1].ErrorClass)
+	assert.Equal(t, socketcan.CANErrRestarted, errFrames[2].ErrorClass)
+}
+
+func TestTxEchoRequiresVxcan(t *testing.T) {
+	_, err := NewSocketCANEndpoint(Config{Interface: "lo", TxEcho: true})
+	assert.NotNil(t, err)
+}
+
+func TestGatewayFailsOnEndpointError(t *testing.T) {
+	dev := newMemEndpoint()
+	bus := newMemEndpoint()
+	g := NewWithEndpoints(Config{Interface: "memtest1"}, dev, bus)
+	assert.Nil(t, g.Start(context.Background()))
+
+	bus.rxErr <- errors.New("interface down")
+	select {
+	case <-g.Done():
+	case <-time.After(time.Second):
+		t.Fatal("gateway not terminated")
+	}
+	assert.NotNil(t, g.Err())
+	assert.True(t, dev.isClosed())
+	assert.True(t, bus.isClosed())
+}
+
+func TestGatewayMetricsPerGateway(t *testing.T) {
+	m1 := NewMetrics()
+	m2 := NewMetrics()
+	reg := prometheus.NewPedanticRegistry()
+	assert.Nil(t, reg.Register(m1))
+	assert.NotNil(t, reg.Register(m2), "second registration of the same metrics must fail")
+
+	dev := newMemEndpoint()
+	bus := newMemEndpoint()
+	g := NewWithEndpoints(Config{Interface: "memtest0", Metrics: m1}, dev, bus)
+	assert.Nil(t, g.Start(context.Background()))
+	defer g.Stop()
+
+	dev.rx <- Event{Frame: &socketcan.CANFrame{ID: 0x123, DLC: 2, Data: []byte{1, 2}}}
+	assert.Eventually(t, func() bool { return len(bus.sentFrames()) == 1 }, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m1.framesTotal.WithLabelValues("memtest0", dirToSocketCAN)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m2.framesTotal.WithLabelValues("memtest0", dirToSocketCAN)))
+}
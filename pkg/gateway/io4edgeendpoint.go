@@ -0,0 +1,340 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ci4rail/io4edge-client-go/functionblock"
+	fspb "github.com/ci4rail/io4edge_api/canL2/go/canL2/v1alpha1"
+	fbv1 "github.com/ci4rail/io4edge_api/io4edge/go/functionblock/v1alpha1"
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+const (
+	bucketSamples     = 30
+	bufferedSamples   = 400
+	streamKeepAliveMs = 1000
+	// streamLostTimeout is the time without stream data after which the connection is considered lost
+	streamLostTimeout = 3 * streamKeepAliveMs * time.Millisecond
+	// streamPollInterval is the interval in which the stream reader checks whether the endpoint has been closed
+	streamPollInterval = 200 * time.Millisecond
+)
+
+// AcceptanceFilter is the filter applied by the io4edge device on the stream.
+// A frame is streamed if <frame_id> & Mask == Code & Mask. A zero mask streams all frames.
+type AcceptanceFilter struct {
+	Code uint32
+	Mask uint32
+}
+
+// ParseAcceptanceFilter parses an acceptance filter of the form <code>:<mask> (hexadecimal values)
+func ParseAcceptanceFilter(s string) (AcceptanceFilter, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return AcceptanceFilter{}, fmt.Errorf("invalid acceptance filter %s: expected <code>:<mask>", s)
+	}
+	code, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return AcceptanceFilter{}, fmt.Errorf("invalid acceptance code %s: %v", parts[0], err)
+	}
+	mask, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return AcceptanceFilter{}, fmt.Errorf("invalid acceptance mask %s: %v", parts[1], err)
+	}
+	return AcceptanceFilter{Code: uint32(code), Mask: uint32(mask)}, nil
+}
+
+// Io4edgeEndpoint is a FrameEndpoint on an io4edge CANL2 function block.
+// The stream is read in the background. If the connection is lost, the endpoint reconnects
+// and reports a CANErrRestarted error event. Receive timestamps are mapped to host time.
+type Io4edgeEndpoint struct {
+	conn       *io4edgeConnection
+	log        *logger
+	vcan       string // label for metrics
+	metrics    *Metrics
+	events     chan Event // received frames, error events and controller state changes in stream order
+	readerDone chan struct{}
+	reconnects uint64
+
+	busOffRestart time.Duration
+	restartTimer  *time.Timer // pending bus off restart, only accessed by the stream reader and Close
+
+	mu              sync.Mutex // protects controllerState
+	controllerState fspb.ControllerState
+}
+
+// NewIo4edgeEndpoint connects to the io4edge device cfg.Address, configures the CAN controller
+// if cfg.Bus is set and starts the stream with cfg.AcceptanceFilter.
+// cfg.Interface is only used to label cfg.Metrics.
+func NewIo4edgeEndpoint(cfg Config) (*Io4edgeEndpoint, error) {
+	if cfg.BusOffRestart != 0 && cfg.Bus == nil {
+		return nil, fmt.Errorf("bus off restart requires a bus configuration")
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = NewMetrics()
+	}
+	log := newLogger(cfg)
+	e := &Io4edgeEndpoint{
+		conn:          newIo4edgeConnection(cfg.Address, cfg.Bus, cfg.AcceptanceFilter, log),
+		log:           log,
+		vcan:          cfg.Interface,
+		metrics:       cfg.Metrics,
+		events:        make(chan Event, 128),
+		readerDone:    make(chan struct{}),
+		busOffRestart: cfg.BusOffRestart,
+	}
+	e.conn.onReconnect = func() {
+		atomic.AddUint64(&e.reconnects, 1)
+		e.metrics.reconnectsTotal.WithLabelValues(e.vcan).Inc()
+	}
+	if err := e.conn.connect(); err != nil {
+		return nil, err
+	}
+	go e.readStream()
+	return e, nil
+}
+
+// Send sends the frames to the io4edge device. Frames are not buffered.
+// If the transmit queue of the device has no space for all frames, none of them is sent and an error wrapping
+// ErrTxQueueFull is returned.
+func (e *Io4edgeEndpoint) Send(frames []*socketcan.CANFrame) error {
+	client := e.conn.getClient()
+	if client == nil {
+		return fmt.Errorf("not connected to io4edge device")
+	}
+	io4eFrames := make([]*fspb.Frame, len(frames))
+	for i, f := range frames {
+		io4eFrames[i] = socketCANToIo4EdgeFrame(f)
+	}
+	err := client.SendFrames(io4eFrames)
+	if functionblock.HaveResponseStatus(err, fbv1.Status_TEMPORARILY_UNAVAILABLE) {
+		return fmt.Errorf("%w: %v", ErrTxQueueFull, err)
+	}
+	return err
+}
+
+// SendErrorFrame does nothing, error frames can't be sent to an io4edge device
+func (e *Io4edgeEndpoint) SendErrorFrame(f *socketcan.CANErrorFrame) error {
+	return nil
+}
+
+// Receive waits for events from the io4edge stream and returns the events received so far, up to bucketSamples events.
+// The events are the received frames, the error events of the device and the controller state changes as error frames.
+func (e *Io4edgeEndpoint) Receive(ctx context.Context) ([]Event, error) {
+	var events []Event
+	// wait for first event
+	select {
+	case ev := <-e.events:
+		events = append(events, ev)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-e.conn.closedCh:
+		return nil, ErrEndpointClosed
+	}
+	e.metrics.setQueueDepth(e.vcan, dirToSocketCAN, len(e.events))
+
+	// read other events, but non-blocking, up to a bucket per call
+	for len(events) < bucketSamples {
+		select {
+		case ev := <-e.events:
+			events = append(events, ev)
+		default: // queue is empty
+			return events, nil
+		}
+	}
+	return events, nil
+}
+
+// Close stops the stream and closes the connection to the device
+func (e *Io4edgeEndpoint) Close() error {
+	e.conn.close()
+	<-e.readerDone
+	if e.restartTimer != nil {
+		e.restartTimer.Stop()
+	}
+	return nil
+}
+
+// ConnectionState returns the state of the connection to the device as a string
+func (e *Io4edgeEndpoint) ConnectionState() string {
+	return e.conn.getState().String()
+}
+
+// ControllerState returns the last reported state of the CAN controller
+func (e *Io4edgeEndpoint) ControllerState() fspb.ControllerState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.controllerState
+}
+
+// Reconnects returns the number of reconnects to the device
+func (e *Io4edgeEndpoint) Reconnects() uint64 {
+	return atomic.LoadUint64(&e.reconnects)
+}
+
+func (e *Io4edgeEndpoint) setControllerState(state fspb.ControllerState) {
+	e.mu.Lock()
+	e.controllerState = state
+	e.mu.Unlock()
+	e.metrics.setControllerState(e.vcan, state)
+}
+
+// readStream reads the stream until the endpoint is closed, reconnects if the stream is lost
+func (e *Io4edgeEndpoint) readStream() {
+	defer close(e.readerDone)
+	var busState fspb.ControllerState = fspb.ControllerState_CAN_OK
+	clock := &clockMapper{}
+	e.setControllerState(busState)
+
+	lastData := time.Now()
+	for {
+		// read next bucket from stream or null bucket
+		client := e.conn.getClient()
+		if client == nil {
+			// connection closed
+			return
+		}
+		sd, err := client.ReadStream(streamPollInterval)
+		if err != nil {
+			if e.conn.isClosed() {
+				return
+			}
+			if time.Since(lastData) < streamLostTimeout {
+				continue
+			}
+			// no keep alive means the connection to the device is lost
+			e.log.printf("Io4Edge ReadStream failed: %v, reconnecting\n", err)
+			e.conn.reconnect()
+			if e.conn.isClosed() {
+				return
+			}
+			e.log.printf("Io4Edge stream restarted\n")
+			lastData = time.Now()
+			if !e.sendErrorEvent(&socketcan.CANErrorFrame{ErrorClass: socketcan.CANErrRestarted}) {
+				return
+			}
+			continue
+		}
+		lastData = time.Now()
+		clock.update(sd.DeliveryTimestamp, time.Now())
+
+		samples := sd.FSData.Samples
+		if len(samples) > 0 {
+			e.log.verbosef("Got %d samples from io4edge device\n", len(samples))
+		}
+		for _, s := range samples {
+			if s.ControllerState != busState {
+				if !e.controllerStateChanged(busState, s.ControllerState) {
+					return
+				}
+				busState = s.ControllerState
+				e.setControllerState(busState)
+			}
+			if s.Error != fspb.ErrorEvent_CAN_NO_ERROR {
+				e.log.verbosef("Got Error Event %v\n", s.Error)
+				e.metrics.errorEventsTotal.WithLabelValues(e.vcan, s.Error.String()).Inc()
+				if !e.sendErrorEvent(io4EdgeErrorEventToSocketCANErrorFrame(s.Error)) {
+					return
+				}
+			}
+			if s.IsDataFrame {
+				f := io4EdgeSampleToSocketCANFrame(s)
+				f.Timestamp = clock.toHost(s.Timestamp)
+				select {
+				case e.events <- Event{Frame: f}:
+				case <-e.conn.closedCh:
+					return
+				}
+			}
+		}
+	}
+}
+
+// sendErrorEvent queues an error event. Returns false if the endpoint has been closed
+func (e *Io4edgeEndpoint) sendErrorEvent(f *socketcan.CANErrorFrame) bool {
+	select {
+	case e.events <- Event{ErrorFrame: f}:
+		return true
+	case <-e.conn.closedCh:
+		return false
+	}
+}
+
+func io4EdgeSampleToSocketCANFrame(sample *fspb.Sample) *socketcan.CANFrame {
+	return &socketcan.CANFrame{
+		ID:       sample.Frame.MessageId,
+		DLC:      uint8(len(sample.Frame.Data)),
+		Data:     sample.Frame.Data,
+		Extended: sample.Frame.ExtendedFrameFormat,
+		RTR:      sample.Frame.RemoteFrame,
+		// frames with more than 8 data bytes can only be CAN FD frames
+		FD: len(sample.Frame.Data) > socketcan.CANMaxDLen,
+	}
+}
+
+func io4EdgeErrorEventToSocketCANErrorFrame(ev fspb.ErrorEvent) *socketcan.CANErrorFrame {
+	f := &socketcan.CANErrorFrame{}
+	switch ev {
+	case fspb.ErrorEvent_CAN_TX_FAILED:
+		f.ErrorClass = socketcan.CANErrTxTimeout | socketcan.CANErrAck
+	case fspb.ErrorEvent_CAN_RX_QUEUE_FULL:
+		f.ErrorClass = socketcan.CANErrCtrl
+		f.CANCtrlErrorDetails = socketcan.CANErrCtrlRxOverflow
+	case fspb.ErrorEvent_CAN_ARB_LOST:
+		f.ErrorClass = socketcan.CANErrLostArb
+	case fspb.ErrorEvent_CAN_BUS_ERROR:
+		f.ErrorClass = socketcan.CANErrBusError
+	}
+	return f
+}
+
+// controllerStateChanged reports a state change of the CAN controller as error frames
+// and handles the automatic restart after bus off. Returns false if the endpoint has been closed
+func (e *Io4edgeEndpoint) controllerStateChanged(oldState fspb.ControllerState, newState fspb.ControllerState) bool {
+	from := canStateFromIo4edge(oldState)
+	to := canStateFromIo4edge(newState)
+	e.log.printf("CAN controller state %v -> %v\n", from, to)
+
+	if e.busOffRestart != 0 {
+		if to == canStateBusOff {
+			e.log.printf("restarting CAN controller in %v\n", e.busOffRestart)
+			e.restartTimer = time.AfterFunc(e.busOffRestart, e.restartController)
+		} else if e.restartTimer != nil {
+			e.restartTimer.Stop()
+			e.restartTimer = nil
+		}
+	}
+
+	// the io4edge device doesn't report error counters
+	for _, f := range stateChangeErrorFrames(from, to, nil) {
+		if !e.sendErrorEvent(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// restartController restarts the CAN controller after bus off
+func (e *Io4edgeEndpoint) restartController() {
+	if err := e.conn.restartController(); err != nil {
+		e.log.printf("restart of CAN controller failed: %v\n", err)
+	}
+}
+
+// socketCANToIo4EdgeFrame converts a socketcan frame into an io4edge frame.
+// For CAN FD frames, the whole payload is passed. The io4edge frame has no representation for the BRS and ESI flags.
+func socketCANToIo4EdgeFrame(s *socketcan.CANFrame) *fspb.Frame {
+	f := &fspb.Frame{
+		MessageId:           s.ID,
+		RemoteFrame:         s.RTR,
+		ExtendedFrameFormat: s.Extended,
+	}
+	f.Data = make([]byte, s.DLC)
+	copy(f.Data, s.Data[0:s.DLC])
+	return f
+}
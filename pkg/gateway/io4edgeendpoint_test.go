@@ -0,0 +1,157 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fspb "github.com/ci4rail/io4edge_api/canL2/go/canL2/v1alpha1"
+	fbv1 "github.com/ci4rail/io4edge_api/io4edge/go/functionblock/v1alpha1"
+	"github.com/ci4rail/socketcan-io4edge/pkg/io4edgefake"
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAcceptanceFilter(t *testing.T) {
+	f, err := ParseAcceptanceFilter("100:700")
+	assert.Nil(t, err)
+	assert.Equal(t, AcceptanceFilter{Code: 0x100, Mask: 0x700}, f)
+
+	f, err = ParseAcceptanceFilter("12345678:1FFFFFFF")
+	assert.Nil(t, err)
+	assert.Equal(t, AcceptanceFilter{Code: 0x12345678, Mask: 0x1FFFFFFF}, f)
+
+	_, err = ParseAcceptanceFilter("100")
+	assert.NotNil(t, err)
+	_, err = ParseAcceptanceFilter("100:xyz")
+	assert.NotNil(t, err)
+}
+
+// startFakeDeviceGateway starts a gateway between srv and bus. Address, Interface and Bus of cfg are set by the function
+func startFakeDeviceGateway(t *testing.T, srv *io4edgefake.Server, bus *memEndpoint, cfg Config) *Gateway {
+	cfg.Address = srv.Address()
+	cfg.Interface = "fake0"
+	cfg.Bus = &BusConfig{BitRate: 250000, SamplePoint: 0.875, SJW: 1}
+	dev, err := NewIo4edgeEndpoint(cfg)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	g := NewWithEndpoints(cfg, dev, bus)
+	assert.Nil(t, g.Start(context.Background()))
+	return g
+}
+
+func TestGatewayWithFakeDevice(t *testing.T) {
+	srv, err := io4edgefake.NewServer()
+	assert.Nil(t, err)
+	defer srv.Close()
+	bus := newMemEndpoint()
+	g := startFakeDeviceGateway(t, srv, bus, Config{})
+	defer g.Stop()
+
+	assert.Equal(t, uint32(250000), srv.Configuration().Baud)
+	assert.Equal(t, int32(875), srv.Configuration().SamplePoint)
+
+	// io4edge -> socketcan
+	srv.InjectFrame(&fspb.Frame{MessageId: 0x123, Data: []byte{1, 2, 3}})
+	assert.Eventually(t, func() bool { return len(bus.sentFrames()) == 1 }, time.Second, 10*time.Millisecond)
+	f := bus.sentFrames()[0]
+	assert.Equal(t, uint32(0x123), f.ID)
+	assert.Equal(t, []byte{1, 2, 3}, f.Data[:f.DLC])
+	assert.False(t, f.Timestamp.IsZero())
+
+	// socketcan -> io4edge
+	bus.rx <- Event{Frame: &socketcan.CANFrame{ID: 0x1234567, DLC: 2, Data: []byte{4, 5}, Extended: true}}
+	assert.Eventually(t, func() bool { return len(srv.TransmittedFrames()) == 1 }, time.Second, 10*time.Millisecond)
+	tf := srv.TransmittedFrames()[0]
+	assert.Equal(t, uint32(0x1234567), tf.MessageId)
+	assert.True(t, tf.ExtendedFrameFormat)
+	assert.Equal(t, []byte{4, 5}, tf.Data)
+
+	// error events and controller state changes
+	srv.InjectErrorEvent(fspb.ErrorEvent_CAN_ARB_LOST)
+	srv.SetControllerState(fspb.ControllerState_CAN_BUS_OFF)
+	assert.Eventually(t, func() bool { return len(bus.sentErrorFrames()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, socketcan.CANErrLostArb, bus.sentErrorFrames()[0].ErrorClass)
+	assert.Equal(t, socketcan.CANErrBusOff, bus.sentErrorFrames()[1].ErrorClass)
+	assert.Equal(t, fspb.ControllerState_CAN_BUS_OFF, g.Status().ControllerState)
+	assert.Equal(t, "streaming", g.Status().Connection)
+}
+
+func TestGatewayReconnectsToFakeDevice(t *testing.T) {
+	if testing.Short() {
+		t.Skip("reconnect takes a few seconds")
+	}
+	srv, err := io4edgefake.NewServer()
+	assert.Nil(t, err)
+	defer srv.Close()
+	bus := newMemEndpoint()
+	g := startFakeDeviceGateway(t, srv, bus, Config{})
+	defer g.Stop()
+
+	srv.Disconnect()
+	// the lost stream is detected by the missing keep alive messages
+	assert.Eventually(t, func() bool { return len(bus.sentErrorFrames()) == 1 }, 10*time.Second, 50*time.Millisecond)
+	assert.Equal(t, socketcan.CANErrRestarted, bus.sentErrorFrames()[0].ErrorClass)
+	assert.Equal(t, uint64(1), g.Status().Reconnects)
+
+	srv.InjectFrame(&fspb.Frame{MessageId: 0x7FF, Data: []byte{}})
+	assert.Eventually(t, func() bool { return len(bus.sentFrames()) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestGatewayRestartsAfterBusOff(t *testing.T) {
+	srv, err := io4edgefake.NewServer()
+	assert.Nil(t, err)
+	defer srv.Close()
+	bus := newMemEndpoint()
+	g := startFakeDeviceGateway(t, srv, bus, Config{BusOffRestart: 50 * time.Millisecond})
+	defer g.Stop()
+
+	srv.SetControllerState(fspb.ControllerState_CAN_ERROR_PASSIVE)
+	srv.SetControllerState(fspb.ControllerState_CAN_BUS_OFF)
+	assert.Eventually(t, func() bool { return len(bus.sentErrorFrames()) == 3 }, 2*time.Second, 10*time.Millisecond)
+	ef := bus.sentErrorFrames()
+	assert.Equal(t, socketcan.CANErrCtrl, ef[0].ErrorClass)
+	assert.Equal(t, socketcan.CANErrCtrlTxPassive|socketcan.CANErrCtrlRxPassive, ef[0].CANCtrlErrorDetails)
+	assert.Equal(t, socketcan.CANErrBusOff, ef[1].ErrorClass)
+	assert.Equal(t, socketcan.CANErrRestarted, ef[2].ErrorClass)
+	assert.Eventually(t, func() bool {
+		return g.Status().ControllerState == fspb.ControllerState_CAN_OK
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestGatewayRetriesWhenDeviceQueueFull(t *testing.T) {
+	srv, err := io4edgefake.NewServer()
+	assert.Nil(t, err)
+	defer srv.Close()
+	bus := newMemEndpoint()
+	g := startFakeDeviceGateway(t, srv, bus, Config{})
+	defer g.Stop()
+
+	srv.SetTransmitStatus(fbv1.Status_TEMPORARILY_UNAVAILABLE)
+	bus.rx <- Event{Frame: &socketcan.CANFrame{ID: 0x100, DLC: 1, Data: []byte{1}}}
+	assert.Eventually(t, func() bool { return g.Status().TxRetries >= 2 }, time.Second, 5*time.Millisecond)
+	srv.SetTransmitStatus(fbv1.Status_OK)
+
+	assert.Eventually(t, func() bool { return len(srv.TransmittedFrames()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(0), g.Status().TxDropped)
+	assert.Equal(t, 0, len(bus.sentErrorFrames()))
+}
+
+func TestGatewayReportsDroppedFrames(t *testing.T) {
+	srv, err := io4edgefake.NewServer()
+	assert.Nil(t, err)
+	defer srv.Close()
+	bus := newMemEndpoint()
+	g := startFakeDeviceGateway(t, srv, bus, Config{TxRetryBudget: 20 * time.Millisecond})
+	defer g.Stop()
+
+	srv.SetTransmitStatus(fbv1.Status_TEMPORARILY_UNAVAILABLE)
+	bus.rx <- Event{Frame: &socketcan.CANFrame{ID: 0x100, DLC: 1, Data: []byte{1}}}
+	assert.Eventually(t, func() bool { return len(bus.sentErrorFrames()) == 1 }, time.Second, 5*time.Millisecond)
+	ef := bus.sentErrorFrames()[0]
+	assert.Equal(t, socketcan.CANErrCtrl, ef.ErrorClass)
+	assert.Equal(t, socketcan.CANErrCtrlTxOverflow, ef.CANCtrlErrorDetails)
+	assert.Equal(t, uint64(1), g.Status().TxDropped)
+	assert.Equal(t, 0, len(srv.TransmittedFrames()))
+}
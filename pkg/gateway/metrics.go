@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	fspb "github.com/ci4rail/io4edge_api/canL2/go/canL2/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	dirToSocketCAN   = "to_socketcan"
+	dirFromSocketCAN = "from_socketcan"
+)
+
+// Metrics are the prometheus metrics of gateways. All metrics are labelled with the socketcan interface name (vcan),
+// so several gateways can share them. Metrics is a prometheus.Collector, register it e.g. with prometheus.MustRegister.
+type Metrics struct {
+	framesTotal       *prometheus.CounterVec
+	bytesTotal        *prometheus.CounterVec
+	errorEventsTotal  *prometheus.CounterVec
+	controllerState   *prometheus.GaugeVec
+	queueDepth        *prometheus.GaugeVec
+	sendFailuresTotal *prometheus.CounterVec
+	reconnectsTotal   *prometheus.CounterVec
+	txRetriesTotal    *prometheus.CounterVec
+	txDroppedTotal    *prometheus.CounterVec
+}
+
+// NewMetrics creates the gateway metrics. They are not registered.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		framesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socketcan_io4edge_frames_total",
+			Help: "Number of CAN frames forwarded by the gateway",
+		}, []string{"vcan", "direction"}),
+
+		bytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socketcan_io4edge_bytes_total",
+			Help: "Number of CAN payload bytes forwarded by the gateway",
+		}, []string{"vcan", "direction"}),
+
+		errorEventsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socketcan_io4edge_error_events_total",
+			Help: "Number of error events reported by the io4edge device",
+		}, []string{"vcan", "event"}),
+
+		controllerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "socketcan_io4edge_controller_state",
+			Help: "Current state of the io4edge CAN controller (1 for the active state)",
+		}, []string{"vcan", "state"}),
+
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "socketcan_io4edge_queue_depth",
+			Help: "Number of frames waiting in the gateway queue",
+		}, []string{"vcan", "direction"}),
+
+		sendFailuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socketcan_io4edge_send_failures_total",
+			Help: "Number of failed attempts to send frames to the io4edge device",
+		}, []string{"vcan"}),
+
+		reconnectsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socketcan_io4edge_reconnects_total",
+			Help: "Number of reconnects to the io4edge device",
+		}, []string{"vcan"}),
+
+		txRetriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socketcan_io4edge_tx_retries_total",
+			Help: "Number of retries because the transmit queue of the io4edge device was full",
+		}, []string{"vcan"}),
+
+		txDroppedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socketcan_io4edge_tx_dropped_frames_total",
+			Help: "Number of frames from socketcan that could not be sent to the io4edge device",
+		}, []string{"vcan"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.framesTotal,
+		m.bytesTotal,
+		m.errorEventsTotal,
+		m.controllerState,
+		m.queueDepth,
+		m.sendFailuresTotal,
+		m.reconnectsTotal,
+		m.txRetriesTotal,
+		m.txDroppedTotal,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) countFrame(vcan string, direction string, dataLen int) {
+	m.framesTotal.WithLabelValues(vcan, direction).Inc()
+	m.bytesTotal.WithLabelValues(vcan, direction).Add(float64(dataLen))
+}
+
+func (m *Metrics) setQueueDepth(vcan string, direction string, depth int) {
+	m.queueDepth.WithLabelValues(vcan, direction).Set(float64(depth))
+}
+
+func (m *Metrics) setControllerState(vcan string, state fspb.ControllerState) {
+	for v, name := range fspb.ControllerState_name {
+		if fspb.ControllerState(v) == state {
+			m.controllerState.WithLabelValues(vcan, name).Set(1)
+		} else {
+			m.controllerState.WithLabelValues(vcan, name).Set(0)
+		}
+	}
+}
+
+// deleteMetrics removes all metrics of the gateway for vcan
+func (m *Metrics) deleteMetrics(vcan string) {
+	labels := prometheus.Labels{"vcan": vcan}
+	for _, c := range []interface {
+		DeletePartialMatch(prometheus.Labels) int
+	}{
+		m.framesTotal,
+		m.bytesTotal,
+		m.errorEventsTotal,
+		m.controllerState,
+		m.queueDepth,
+		m.sendFailuresTotal,
+		m.reconnectsTotal,
+		m.txRetriesTotal,
+		m.txDroppedTotal,
+	} {
+		c.DeletePartialMatch(labels)
+	}
+}
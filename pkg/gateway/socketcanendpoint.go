@@ -0,0 +1,115 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"github.com/vishvananda/netlink"
+)
+
+// ParseFilters parses the socketcan receive filters of the gateway in candump syntax, see socketcan.ParseFilters.
+// Error masks (#<error_mask>) are rejected, the gateway doesn't forward error frames to the io4edge device.
+func ParseFilters(s string) ([]socketcan.CANFilter, error) {
+	if strings.Contains(s, "#") {
+		return nil, errors.New("error masks are not supported, error frames can't be sent to the io4edge device")
+	}
+	filters, _, err := socketcan.ParseFilters(s)
+	return filters, err
+}
+
+// checkVxcan returns an error if the interface is not a vxcan interface.
+// Other interfaces, e.g. vcan, echo the frames locally, so the applications would see each frame twice.
+func checkVxcan(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("can't get link type of %s: %v", name, err)
+	}
+	if l.Type() != "vxcan" {
+		return fmt.Errorf("tx echo requires a vxcan interface, %s is %s", name, l.Type())
+	}
+	return nil
+}
+
+// SocketCANEndpoint is a FrameEndpoint on a socketcan interface
+type SocketCANEndpoint struct {
+	socket    *socketcan.RawInterface
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewSocketCANEndpoint opens the socketcan interface cfg.Interface and applies the filters of cfg
+// With cfg.TxEcho, cfg.Interface must be a vxcan interface.
+func NewSocketCANEndpoint(cfg Config) (*SocketCANEndpoint, error) {
+	if cfg.TxEcho {
+		if err := checkVxcan(cfg.Interface); err != nil {
+			return nil, err
+		}
+	}
+	socket, err := socketcan.NewRawInterface(cfg.Interface, socketcan.WithFDMode(cfg.FDMode))
+	if err != nil {
+		return nil, fmt.Errorf("error creating socketcan interface: %v", err)
+	}
+	if cfg.Filters != nil {
+		if err := socket.SetFilters(cfg.Filters); err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	return &SocketCANEndpoint{
+		socket: socket,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Send writes the frames to the socket in batches. All frames are tried, the first error is returned
+func (e *SocketCANEndpoint) Send(frames []*socketcan.CANFrame) error {
+	var firstErr error
+	for len(frames) > 0 {
+		n, err := e.socket.SendBatch(frames)
+		if err == nil {
+			break
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		// skip the frame that failed
+		frames = frames[n+1:]
+	}
+	return firstErr
+}
+
+// SendErrorFrame writes an error frame to the socket
+func (e *SocketCANEndpoint) SendErrorFrame(f *socketcan.CANErrorFrame) error {
+	return e.socket.SendErrorFrame(f)
+}
+
+// Receive waits for the next frames from the socket. Returns up to maxFramesPerIo4EdgeCANSend frames
+func (e *SocketCANEndpoint) Receive(ctx context.Context) ([]Event, error) {
+	select {
+	case <-e.closed:
+		return nil, ErrEndpointClosed
+	default:
+	}
+	frames, err := e.socket.ReceiveBatchContext(ctx, maxFramesPerIo4EdgeCANSend)
+	if err == socketcan.ErrClosed {
+		return nil, ErrEndpointClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return frameEvents(frames), nil
+}
+
+// Close closes the socket. A pending Receive returns ErrEndpointClosed
+func (e *SocketCANEndpoint) Close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		err = e.socket.Close()
+	})
+	return err
+}
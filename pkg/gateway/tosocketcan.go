@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// toSocketCAN starts the gateway from the io4edge endpoint to the socketcan endpoint.
+// Frames and error frames are written in the order the io4edge endpoint received them.
+// If a timestamp log is configured, the received frames are logged with their timestamps.
+func (g *Gateway) toSocketCAN(ctx context.Context) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		for {
+			events, err := g.io4edge.Receive(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				g.log.printf("Error reading from io4edge device: %v\n", err)
+				g.fail(fmt.Errorf("error reading from io4edge device: %v", err))
+				return
+			}
+			// consecutive frames are written as batch, error frames between them keep their position
+			var frames []*socketcan.CANFrame
+			for _, ev := range events {
+				if ev.Frame != nil {
+					frames = append(frames, ev.Frame)
+					continue
+				}
+				g.sendFramesToSocketCAN(frames)
+				frames = nil
+				g.sendErrorFrameToSocketCAN(ev.ErrorFrame)
+				if lost := g.echoLost(ev.ErrorFrame); lost != nil {
+					g.sendErrorFrameToSocketCAN(lost)
+				}
+			}
+			g.sendFramesToSocketCAN(frames)
+			if g.tsLog != nil {
+				g.tsLog.flush()
+			}
+		}
+	}()
+}
+
+func (g *Gateway) sendFramesToSocketCAN(frames []*socketcan.CANFrame) {
+	if len(frames) == 0 {
+		return
+	}
+	if err := g.socketCAN.Send(frames); err != nil {
+		g.log.printf("Error writing to CAN socket: %v\n", err)
+	} else {
+		for _, f := range frames {
+			atomic.AddUint64(&g.framesToSocketCAN, 1)
+			g.cfg.Metrics.countFrame(g.cfg.Interface, dirToSocketCAN, int(f.DLC))
+		}
+	}
+	if g.tsLog != nil {
+		for _, f := range frames {
+			g.tsLog.log(f.Timestamp, f)
+		}
+	}
+}
+
+func (g *Gateway) sendErrorFrameToSocketCAN(f *socketcan.CANErrorFrame) {
+	if err := g.socketCAN.SendErrorFrame(f); err != nil {
+		g.log.printf("Error writing error frame: %v\n", err)
+	}
+}
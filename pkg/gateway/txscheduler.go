@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// TxPolicy defines the order in which frames from socketcan are sent to the io4edge device
+type TxPolicy int
+
+const (
+	// TxPolicyFIFO sends the frames in the order they have been received from socketcan
+	TxPolicyFIFO TxPolicy = iota
+	// TxPolicyPriority sends the waiting frames in the order of CAN arbitration, i.e. the lowest ID first.
+	// Frames with the same ID keep their order.
+	TxPolicyPriority
+)
+
+func (p TxPolicy) String() string {
+	switch p {
+	case TxPolicyFIFO:
+		return "fifo"
+	case TxPolicyPriority:
+		return "priority"
+	}
+	return "unknown"
+}
+
+// ParseTxPolicy parses a TxPolicy name (fifo, priority)
+func ParseTxPolicy(s string) (TxPolicy, error) {
+	for _, p := range []TxPolicy{TxPolicyFIFO, TxPolicyPriority} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return TxPolicyFIFO, fmt.Errorf("invalid tx policy %s: expected fifo or priority", s)
+}
+
+// ParseTxRateLimits parses comma separated rate limits of the form <id>:<min_interval>, e.g. 100:10ms,7FF:1s.
+// The ID is hexadecimal, the interval is a go duration.
+func ParseTxRateLimits(s string) (map[uint32]time.Duration, error) {
+	limits := make(map[uint32]time.Duration)
+	for _, l := range strings.Split(s, ",") {
+		parts := strings.Split(l, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %s: expected <id>:<interval>", l)
+		}
+		id, err := strconv.ParseUint(parts[0], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit id %s: %v", parts[0], err)
+		}
+		interval, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit interval %s: %v", parts[1], err)
+		}
+		limits[uint32(id)] = interval
+	}
+	return limits, nil
+}
+
+// txScheduler orders the frames waiting to be sent to the io4edge device according to a TxPolicy
+// and delays frames that would exceed the rate limit of their ID.
+type txScheduler struct {
+	policy   TxPolicy
+	limits   map[uint32]time.Duration // minimum interval between frames with the same ID
+	lastSent map[uint32]time.Time
+	pending  []*socketcan.CANFrame // in send order
+}
+
+func newTxScheduler(policy TxPolicy, limits map[uint32]time.Duration) *txScheduler {
+	return &txScheduler{
+		policy:   policy,
+		limits:   limits,
+		lastSent: make(map[uint32]time.Time),
+	}
+}
+
+// push adds a frame
+func (s *txScheduler) push(f *socketcan.CANFrame) {
+	if s.policy == TxPolicyFIFO {
+		s.pending = append(s.pending, f)
+		return
+	}
+	// insert behind all frames that win arbitration against f or have the same ID
+	i := sort.Search(len(s.pending), func(i int) bool { return arbitrationLess(f, s.pending[i]) })
+	s.pending = append(s.pending, nil)
+	copy(s.pending[i+1:], s.pending[i:])
+	s.pending[i] = f
+}
+
+// len returns the number of waiting frames
+func (s *txScheduler) len() int {
+	return len(s.pending)
+}
+
+// next removes and returns up to max frames that may be sent at now.
+// If frames are waiting but none may be sent because of rate limits, wait is the time until the next one may be sent.
+// With TxPolicyFIFO, a rate limited frame also delays all frames behind it.
+func (s *txScheduler) next(now time.Time, max int) (frames []*socketcan.CANFrame, wait time.Duration) {
+	remaining := s.pending[:0]
+	for i, f := range s.pending {
+		if len(frames) >= max {
+			remaining = append(remaining, s.pending[i:]...)
+			break
+		}
+		if d := s.delay(f, now); d > 0 {
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			if s.policy == TxPolicyFIFO {
+				remaining = append(remaining, s.pending[i:]...)
+				break
+			}
+			remaining = append(remaining, f)
+			continue
+		}
+		if _, ok := s.limits[f.ID]; ok {
+			s.lastSent[f.ID] = now
+		}
+		frames = append(frames, f)
+	}
+	// clear references to the removed frames
+	for i := len(remaining); i < len(s.pending); i++ {
+		s.pending[i] = nil
+	}
+	s.pending = remaining
+	if len(frames) > 0 {
+		wait = 0
+	}
+	return frames, wait
+}
+
+// delay returns how long f must wait because of the rate limit of its ID
+func (s *txScheduler) delay(f *socketcan.CANFrame, now time.Time) time.Duration {
+	interval, ok := s.limits[f.ID]
+	if !ok {
+		return 0
+	}
+	last, ok := s.lastSent[f.ID]
+	if !ok {
+		return 0
+	}
+	return last.Add(interval).Sub(now)
+}
+
+// arbitrationLess returns true if a wins the CAN arbitration against b.
+// The 11 bit base IDs are compared first. With equal base IDs, standard frames win against extended frames.
+// Frames with the same ID, data or remote frames, are equal, so that they keep their order.
+func arbitrationLess(a, b *socketcan.CANFrame) bool {
+	baseA, baseB := baseID(a), baseID(b)
+	if baseA != baseB {
+		return baseA < baseB
+	}
+	if a.Extended != b.Extended {
+		return !a.Extended
+	}
+	return a.ID < b.ID
+}
+
+func baseID(f *socketcan.CANFrame) uint32 {
+	if f.Extended {
+		return f.ID >> 18
+	}
+	return f.ID
+}
@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"github.com/stretchr/testify/assert"
+)
+
+func frameIDs(frames []*socketcan.CANFrame) []uint32 {
+	ids := []uint32{}
+	for _, f := range frames {
+		ids = append(ids, f.ID)
+	}
+	return ids
+}
+
+func TestTxSchedulerFIFO(t *testing.T) {
+	s := newTxScheduler(TxPolicyFIFO, nil)
+	for _, id := range []uint32{0x300, 0x100, 0x200, 0x100} {
+		s.push(&socketcan.CANFrame{ID: id})
+	}
+	frames, _ := s.next(time.Now(), 3)
+	assert.Equal(t, []uint32{0x300, 0x100, 0x200}, frameIDs(frames))
+	frames, _ = s.next(time.Now(), 3)
+	assert.Equal(t, []uint32{0x100}, frameIDs(frames))
+	assert.Equal(t, 0, s.len())
+}
+
+func TestTxSchedulerPriorityKeepsOrderPerID(t *testing.T) {
+	s := newTxScheduler(TxPolicyPriority, nil)
+	for i, id := range []uint32{0x300, 0x100, 0x200, 0x100, 0x300} {
+		s.push(&socketcan.CANFrame{ID: id, DLC: 1, Data: []byte{byte(i)}})
+	}
+	frames, _ := s.next(time.Now(), 10)
+	assert.Equal(t, []uint32{0x100, 0x100, 0x200, 0x300, 0x300}, frameIDs(frames))
+	// frames with the same ID in receive order
+	assert.Equal(t, byte(1), frames[0].Data[0])
+	assert.Equal(t, byte(3), frames[1].Data[0])
+	assert.Equal(t, byte(0), frames[3].Data[0])
+	assert.Equal(t, byte(4), frames[4].Data[0])
+}
+
+func TestTxSchedulerPriorityKeepsOrderOfDataAndRemoteFrames(t *testing.T) {
+	s := newTxScheduler(TxPolicyPriority, nil)
+	rtr := &socketcan.CANFrame{ID: 0x100, RTR: true, DLC: 2}
+	data := &socketcan.CANFrame{ID: 0x100, DLC: 1, Data: []byte{1}}
+	rtr2 := &socketcan.CANFrame{ID: 0x100, RTR: true, DLC: 3}
+	for _, f := range []*socketcan.CANFrame{rtr, data, rtr2} {
+		s.push(f)
+	}
+	frames, _ := s.next(time.Now(), 10)
+	assert.Equal(t, []*socketcan.CANFrame{rtr, data, rtr2}, frames)
+}
+
+func TestArbitrationOrder(t *testing.T) {
+	std := &socketcan.CANFrame{ID: 0x123}
+	stdRTR := &socketcan.CANFrame{ID: 0x123, RTR: true}
+	ext := &socketcan.CANFrame{ID: 0x123 << 18, Extended: true}
+	extLow := &socketcan.CANFrame{ID: 0x122<<18 | 0x3FFFF, Extended: true}
+
+	assert.False(t, arbitrationLess(std, stdRTR))
+	assert.False(t, arbitrationLess(stdRTR, std))
+	assert.True(t, arbitrationLess(stdRTR, ext))
+	assert.True(t, arbitrationLess(extLow, std))
+	assert.False(t, arbitrationLess(std, std))
+}
+
+func TestTxSchedulerRateLimit(t *testing.T) {
+	now := time.Now()
+	limits := map[uint32]time.Duration{0x100: 10 * time.Millisecond}
+
+	s := newTxScheduler(TxPolicyPriority, limits)
+	for _, id := range []uint32{0x100, 0x100, 0x200} {
+		s.push(&socketcan.CANFrame{ID: id})
+	}
+	frames, _ := s.next(now, 10)
+	assert.Equal(t, []uint32{0x100, 0x200}, frameIDs(frames))
+	frames, wait := s.next(now.Add(4*time.Millisecond), 10)
+	assert.Equal(t, 0, len(frames))
+	assert.Equal(t, 6*time.Millisecond, wait)
+	frames, _ = s.next(now.Add(10*time.Millisecond), 10)
+	assert.Equal(t, []uint32{0x100}, frameIDs(frames))
+
+	// with FIFO, the rate limited frame delays the following frames
+	s = newTxScheduler(TxPolicyFIFO, limits)
+	for _, id := range []uint32{0x100, 0x100, 0x200} {
+		s.push(&socketcan.CANFrame{ID: id})
+	}
+	frames, _ = s.next(now, 10)
+	assert.Equal(t, []uint32{0x100}, frameIDs(frames))
+	frames, wait = s.next(now, 10)
+	assert.Equal(t, 0, len(frames))
+	assert.Equal(t, 10*time.Millisecond, wait)
+	frames, _ = s.next(now.Add(10*time.Millisecond), 10)
+	assert.Equal(t, []uint32{0x100, 0x200}, frameIDs(frames))
+}
+
+func TestParseTxRateLimits(t *testing.T) {
+	l, err := ParseTxRateLimits("100:10ms,7FF:1s")
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint32]time.Duration{0x100: 10 * time.Millisecond, 0x7FF: time.Second}, l)
+	_, err = ParseTxRateLimits("100")
+	assert.NotNil(t, err)
+	_, err = ParseTxRateLimits("100:10")
+	assert.NotNil(t, err)
+
+	p, err := ParseTxPolicy("priority")
+	assert.Nil(t, err)
+	assert.Equal(t, TxPolicyPriority, p)
+	_, err = ParseTxPolicy("lifo")
+	assert.NotNil(t, err)
+}
+
+func TestGatewaySendsByPriority(t *testing.T) {
+	dev := newMemEndpoint()
+	dev.sendGate = make(chan struct{})
+	bus := newMemEndpoint()
+	g := NewWithEndpoints(Config{Interface: "memtest3", TxPolicy: TxPolicyPriority}, dev, bus)
+	assert.Nil(t, g.Start(context.Background()))
+	defer g.Stop()
+
+	// the first frame blocks the writer until the gate is opened, the others are waiting in the scheduler
+	bus.rx <- Event{Frame: &socketcan.CANFrame{ID: 0x400}}
+	assert.Eventually(t, func() bool { return dev.numSendCalls() == 1 }, time.Second, time.Millisecond)
+	for _, id := range []uint32{0x300, 0x100, 0x300, 0x050} {
+		bus.rx <- Event{Frame: &socketcan.CANFrame{ID: id}}
+	}
+	// the 6th Receive call waits for the next event, so all frames before have been queued
+	assert.Eventually(t, func() bool { return bus.numReceiveCalls() == 6 }, time.Second, time.Millisecond)
+	close(dev.sendGate)
+
+	assert.Eventually(t, func() bool { return len(dev.sentFrames()) == 5 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []uint32{0x400, 0x050, 0x100, 0x300, 0x300}, frameIDs(dev.sentFrames()))
+}
@@ -0,0 +1,481 @@
+// Package io4edgefake emulates an io4edge CANL2 function block on a TCP port.
+// It speaks the io4edge functionblock protocol, so the canl2 client of io4edge-client-go can connect to it.
+//
+// Uploading a configuration re-initializes the emulated CAN controller, i.e. it leaves bus off.
+// Tests script the emulated CAN bus with InjectFrame, InjectErrorEvent and SetControllerState,
+// check the frames transmitted by the client with TransmittedFrames and simulate connection losses with Disconnect.
+package io4edgefake
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ci4rail/io4edge-client-go/transport"
+	fspb "github.com/ci4rail/io4edge_api/canL2/go/canL2/v1alpha1"
+	fbv1 "github.com/ci4rail/io4edge_api/io4edge/go/functionblock/v1alpha1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Server is a fake io4edge CANL2 function block
+type Server struct {
+	ln    net.Listener
+	start time.Time
+	wg    sync.WaitGroup
+
+	mu              sync.Mutex // protects all fields below
+	sessions        map[*session]struct{}
+	config          *fspb.ConfigurationSet
+	controllerState fspb.ControllerState
+	transmitted     []*fspb.Frame
+	transmitStatus  fbv1.Status
+	closed          bool
+}
+
+// NewServer starts a fake device listening on a free port of localhost
+func NewServer() (*Server, error) {
+	return NewServerOnAddress("127.0.0.1:0")
+}
+
+// NewServerOnAddress starts a fake device listening on address (host:port)
+func NewServerOnAddress(address string) (*Server, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:       ln,
+		start:    time.Now(),
+		sessions: make(map[*session]struct{}),
+		config: &fspb.ConfigurationSet{
+			Baud:        500000,
+			SamplePoint: 800,
+			Sjw:         1,
+		},
+		controllerState: fspb.ControllerState_CAN_OK,
+		transmitStatus:  fbv1.Status_OK,
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Address returns the address of the fake device in the form ip:port
+func (s *Server) Address() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the fake device and closes all client connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	err := s.ln.Close()
+	s.Disconnect()
+	s.wg.Wait()
+	return err
+}
+
+// Disconnect closes all client connections. Clients may connect again afterwards.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ss := range s.sessions {
+		ss.conn.Close()
+	}
+}
+
+// Streaming returns the number of clients with a running stream
+func (s *Server) Streaming() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for ss := range s.sessions {
+		if ss.isStreaming() {
+			n++
+		}
+	}
+	return n
+}
+
+// InjectFrame emulates the reception of a frame from the CAN bus.
+// The frame is streamed to all clients with a running stream whose acceptance filter matches.
+func (s *Server) InjectFrame(f *fspb.Frame) {
+	s.inject(&fspb.Sample{
+		Frame:       f,
+		IsDataFrame: true,
+	})
+}
+
+// InjectErrorEvent emulates an error event of the CAN controller
+func (s *Server) InjectErrorEvent(ev fspb.ErrorEvent) {
+	s.inject(&fspb.Sample{
+		Error: ev,
+	})
+}
+
+// SetControllerState changes the state of the CAN controller. The new state is streamed to all clients
+func (s *Server) SetControllerState(state fspb.ControllerState) {
+	s.mu.Lock()
+	s.controllerState = state
+	s.mu.Unlock()
+	s.inject(&fspb.Sample{})
+}
+
+// TransmittedFrames returns all frames the clients sent to the CAN bus
+func (s *Server) TransmittedFrames() []*fspb.Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*fspb.Frame{}, s.transmitted...)
+}
+
+// SetTransmitStatus sets the status returned to the clients when they send frames.
+// Frames are only recorded as transmitted with fbv1.Status_OK.
+// Use fbv1.Status_TEMPORARILY_UNAVAILABLE to emulate a full transmit queue.
+func (s *Server) SetTransmitStatus(status fbv1.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transmitStatus = status
+}
+
+// Configuration returns the current CAN controller configuration
+func (s *Server) Configuration() *fspb.ConfigurationSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return proto.Clone(s.config).(*fspb.ConfigurationSet)
+}
+
+// reinitController emulates the re-initialization of the CAN controller on a new configuration
+func (s *Server) reinitController() {
+	s.mu.Lock()
+	state := s.controllerState
+	s.mu.Unlock()
+	if state != fspb.ControllerState_CAN_OK {
+		s.SetControllerState(fspb.ControllerState_CAN_OK)
+	}
+}
+
+// inject completes the sample with timestamp and controller state and queues it for all streaming clients
+func (s *Server) inject(sample *fspb.Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sample.Timestamp = uint64(time.Since(s.start).Microseconds())
+	sample.ControllerState = s.controllerState
+	for ss := range s.sessions {
+		ss.queueSample(sample)
+	}
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		ss := newSession(s, conn)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.sessions[ss] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			ss.serve()
+			s.mu.Lock()
+			delete(s.sessions, ss)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// handleCommand executes a functionblock command and returns the response
+func (s *Server) handleCommand(ss *session, cmd *fbv1.Command) *fbv1.Response {
+	res := &fbv1.Response{
+		Context: cmd.Context,
+		Status:  fbv1.Status_OK,
+	}
+	var err error
+	switch t := cmd.Type.(type) {
+	case *fbv1.Command_Configuration:
+		err = s.handleConfiguration(t.Configuration, res)
+		if _, ok := t.Configuration.Action.(*fbv1.Configuration_FunctionSpecificConfigurationSet); ok && err == nil {
+			s.reinitController()
+		}
+	case *fbv1.Command_FunctionControl:
+		err = s.handleFunctionControl(t.FunctionControl, res)
+	case *fbv1.Command_StreamControl:
+		err = ss.handleStreamControl(t.StreamControl, res)
+	default:
+		res.Status = fbv1.Status_UNKNOWN_COMMAND
+	}
+	if err != nil {
+		res.Status = fbv1.Status_INVALID_PARAMETER
+		res.Error = &fbv1.Error{Error: err.Error()}
+	}
+	return res
+}
+
+func (s *Server) handleConfiguration(c *fbv1.Configuration, res *fbv1.Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var fsRes proto.Message
+	switch a := c.Action.(type) {
+	case *fbv1.Configuration_FunctionSpecificConfigurationSet:
+		cfg := &fspb.ConfigurationSet{}
+		if err := a.FunctionSpecificConfigurationSet.UnmarshalTo(cfg); err != nil {
+			return err
+		}
+		s.config = cfg
+		fsRes = &fspb.ConfigurationSetResponse{}
+	case *fbv1.Configuration_FunctionSpecificConfigurationGet:
+		fsRes = &fspb.ConfigurationGetResponse{
+			Baud:        s.config.Baud,
+			SamplePoint: s.config.SamplePoint,
+			Sjw:         s.config.Sjw,
+			ListenOnly:  s.config.ListenOnly,
+		}
+	default:
+		res.Status = fbv1.Status_NOT_IMPLEMENTED
+		return nil
+	}
+	anyRes, err := anypb.New(fsRes)
+	if err != nil {
+		return err
+	}
+	cr := &fbv1.ConfigurationResponse{}
+	if _, ok := c.Action.(*fbv1.Configuration_FunctionSpecificConfigurationSet); ok {
+		cr.Action = &fbv1.ConfigurationResponse_FunctionSpecificConfigurationSet{FunctionSpecificConfigurationSet: anyRes}
+	} else {
+		cr.Action = &fbv1.ConfigurationResponse_FunctionSpecificConfigurationGet{FunctionSpecificConfigurationGet: anyRes}
+	}
+	res.Type = &fbv1.Response_Configuration{Configuration: cr}
+	return nil
+}
+
+func (s *Server) handleFunctionControl(c *fbv1.FunctionControl, res *fbv1.Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fcr := &fbv1.FunctionControlResponse{}
+	switch a := c.Action.(type) {
+	case *fbv1.FunctionControl_FunctionSpecificFunctionControlSet:
+		set := &fspb.FunctionControlSet{}
+		if err := a.FunctionSpecificFunctionControlSet.UnmarshalTo(set); err != nil {
+			return err
+		}
+		if s.transmitStatus != fbv1.Status_OK {
+			res.Status = s.transmitStatus
+			res.Error = &fbv1.Error{Error: fmt.Sprintf("can't transmit: %v", s.transmitStatus)}
+			return nil
+		}
+		s.transmitted = append(s.transmitted, set.Frame...)
+		anyRes, err := anypb.New(&fspb.FunctionControlSetResponse{})
+		if err != nil {
+			return err
+		}
+		fcr.Action = &fbv1.FunctionControlResponse_FunctionSpecificFunctionControlSet{FunctionSpecificFunctionControlSet: anyRes}
+	case *fbv1.FunctionControl_FunctionSpecificFunctionControlGet:
+		anyRes, err := anypb.New(&fspb.FunctionControlGetResponse{ControllerState: s.controllerState})
+		if err != nil {
+			return err
+		}
+		fcr.Action = &fbv1.FunctionControlResponse_FunctionSpecificFunctionControlGet{FunctionSpecificFunctionControlGet: anyRes}
+	default:
+		res.Status = fbv1.Status_NOT_IMPLEMENTED
+		return nil
+	}
+	res.Type = &fbv1.Response_FunctionControl{FunctionControl: fcr}
+	return nil
+}
+
+// session is the connection of one client
+type session struct {
+	srv  *Server
+	conn net.Conn
+	ms   *transport.FramedStream // WriteMsg is safe for concurrent use
+
+	mu        sync.Mutex // protects the stream state
+	streaming bool
+	filter    *fspb.StreamControlStart
+	samples   chan *fspb.Sample
+	stop      chan struct{}
+	streamWg  sync.WaitGroup
+}
+
+func newSession(srv *Server, conn net.Conn) *session {
+	return &session{
+		srv:  srv,
+		conn: conn,
+		ms:   transport.NewFramedStreamFromTransport(conn),
+	}
+}
+
+// serve handles the commands of the client until the connection is closed
+func (ss *session) serve() {
+	defer func() {
+		ss.conn.Close()
+		ss.stopStream()
+	}()
+	for {
+		payload, err := ss.ms.ReadMsg()
+		if err != nil {
+			return
+		}
+		cmd := &fbv1.Command{}
+		if err := proto.Unmarshal(payload, cmd); err != nil {
+			return
+		}
+		if err := ss.write(ss.srv.handleCommand(ss, cmd)); err != nil {
+			return
+		}
+	}
+}
+
+func (ss *session) write(res *fbv1.Response) error {
+	payload, err := proto.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return ss.ms.WriteMsg(payload)
+}
+
+func (ss *session) handleStreamControl(c *fbv1.StreamControl, res *fbv1.Response) error {
+	switch a := c.Action.(type) {
+	case *fbv1.StreamControl_Start:
+		filter := &fspb.StreamControlStart{}
+		if err := a.Start.FunctionSpecificStreamControlStart.UnmarshalTo(filter); err != nil {
+			return err
+		}
+		if !ss.startStream(a.Start, filter) {
+			res.Status = fbv1.Status_STREAM_ALREADY_STARTED
+			return nil
+		}
+	case *fbv1.StreamControl_Stop:
+		if !ss.stopStream() {
+			res.Status = fbv1.Status_STREAM_ALREADY_STOPPED
+			return nil
+		}
+	}
+	res.Type = &fbv1.Response_StreamControl{StreamControl: &fbv1.StreamControlResponse{}}
+	return nil
+}
+
+func (ss *session) isStreaming() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.streaming
+}
+
+// startStream starts sending stream data. Returns false if the stream is already running
+func (ss *session) startStream(cfg *fbv1.StreamControlStart, filter *fspb.StreamControlStart) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.streaming {
+		return false
+	}
+	ss.streaming = true
+	ss.filter = filter
+	buffered := cfg.BufferedSamples
+	if buffered == 0 {
+		buffered = 1
+	}
+	ss.samples = make(chan *fspb.Sample, buffered)
+	ss.stop = make(chan struct{})
+	ss.streamWg.Add(1)
+	go ss.stream(cfg, ss.samples, ss.stop)
+	return true
+}
+
+// stopStream stops sending stream data. Returns false if the stream wasn't running
+func (ss *session) stopStream() bool {
+	ss.mu.Lock()
+	if !ss.streaming {
+		ss.mu.Unlock()
+		return false
+	}
+	ss.streaming = false
+	close(ss.stop)
+	ss.mu.Unlock()
+	ss.streamWg.Wait()
+	return true
+}
+
+// queueSample queues a sample for the stream. Data frames not matching the acceptance filter are dropped,
+// as are all samples if the device buffer is full.
+func (ss *session) queueSample(sample *fspb.Sample) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !ss.streaming {
+		return
+	}
+	if sample.IsDataFrame && sample.Frame.MessageId&ss.filter.AcceptanceMask != ss.filter.AcceptanceCode&ss.filter.AcceptanceMask {
+		return
+	}
+	select {
+	case ss.samples <- sample:
+	default:
+	}
+}
+
+// stream sends the queued samples in buckets of up to cfg.BucketSamples samples as soon as they are available.
+// If no samples are available, an empty bucket is sent every keepalive interval.
+func (ss *session) stream(cfg *fbv1.StreamControlStart, samples chan *fspb.Sample, stop chan struct{}) {
+	defer ss.streamWg.Done()
+	keepalive := time.Duration(cfg.KeepaliveInterval) * time.Millisecond
+	if keepalive == 0 {
+		keepalive = time.Second
+	}
+	bucketSamples := int(cfg.BucketSamples)
+	if bucketSamples == 0 {
+		bucketSamples = 1
+	}
+	var seq uint32
+
+	for {
+		bucket := []*fspb.Sample{}
+		select {
+		case <-stop:
+			return
+		case sample := <-samples:
+			bucket = append(bucket, sample)
+		drain:
+			for len(bucket) < bucketSamples {
+				select {
+				case sample := <-samples:
+					bucket = append(bucket, sample)
+				default:
+					break drain
+				}
+			}
+		case <-time.After(keepalive):
+		}
+
+		fsData, err := anypb.New(&fspb.StreamData{Samples: bucket})
+		if err != nil {
+			return
+		}
+		err = ss.write(&fbv1.Response{
+			Status: fbv1.Status_OK,
+			Type: &fbv1.Response_Stream{
+				Stream: &fbv1.StreamData{
+					DeliveryTimestampUs:        uint64(time.Since(ss.srv.start).Microseconds()),
+					Sequence:                   seq,
+					FunctionSpecificStreamData: fsData,
+				},
+			},
+		})
+		if err != nil {
+			return
+		}
+		seq++
+	}
+}
@@ -0,0 +1,80 @@
+package io4edgefake
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ci4rail/io4edge-client-go/canl2"
+	"github.com/ci4rail/io4edge-client-go/functionblock"
+	fspb "github.com/ci4rail/io4edge_api/canL2/go/canL2/v1alpha1"
+	fbv1 "github.com/ci4rail/io4edge_api/io4edge/go/functionblock/v1alpha1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigurationAndTransmit(t *testing.T) {
+	s, err := NewServer()
+	assert.Nil(t, err)
+	defer s.Close()
+
+	c, err := canl2.NewClientFromUniversalAddress(s.Address(), 0)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	assert.Nil(t, c.UploadConfiguration(canl2.WithBitRate(250000), canl2.WithSamplePoint(0.875), canl2.WithListenOnly(true)))
+	cfg := s.Configuration()
+	assert.Equal(t, uint32(250000), cfg.Baud)
+	assert.Equal(t, int32(875), cfg.SamplePoint)
+	assert.True(t, cfg.ListenOnly)
+
+	frames := []*fspb.Frame{{MessageId: 0x100, Data: []byte{1, 2, 3}}}
+	assert.Nil(t, c.SendFrames(frames))
+	assert.Equal(t, 1, len(s.TransmittedFrames()))
+	assert.Equal(t, uint32(0x100), s.TransmittedFrames()[0].MessageId)
+
+	s.SetTransmitStatus(fbv1.Status_TEMPORARILY_UNAVAILABLE)
+	err = c.SendFrames(frames)
+	assert.True(t, functionblock.HaveResponseStatus(err, fbv1.Status_TEMPORARILY_UNAVAILABLE))
+	assert.Equal(t, 1, len(s.TransmittedFrames()))
+}
+
+func TestStream(t *testing.T) {
+	s, err := NewServer()
+	assert.Nil(t, err)
+	defer s.Close()
+
+	c, err := canl2.NewClientFromUniversalAddress(s.Address(), 0)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	assert.Nil(t, c.StartStream(
+		canl2.WithFBStreamOption(functionblock.WithKeepaliveInterval(100)),
+		canl2.WithFilter(0x100, 0x700)))
+	assert.Equal(t, 1, s.Streaming())
+
+	// keepalive bucket
+	sd, err := c.ReadStream(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(sd.FSData.Samples))
+
+	s.InjectFrame(&fspb.Frame{MessageId: 0x200, Data: []byte{1}}) // filtered
+	s.InjectFrame(&fspb.Frame{MessageId: 0x123, Data: []byte{2}})
+	s.InjectErrorEvent(fspb.ErrorEvent_CAN_ARB_LOST)
+	s.SetControllerState(fspb.ControllerState_CAN_BUS_OFF)
+
+	var samples []*fspb.Sample
+	for len(samples) < 3 {
+		sd, err := c.ReadStream(time.Second)
+		assert.Nil(t, err)
+		if err != nil {
+			return
+		}
+		samples = append(samples, sd.FSData.Samples...)
+	}
+	assert.True(t, samples[0].IsDataFrame)
+	assert.Equal(t, uint32(0x123), samples[0].Frame.MessageId)
+	assert.Equal(t, fspb.ErrorEvent_CAN_ARB_LOST, samples[1].Error)
+	assert.Equal(t, fspb.ControllerState_CAN_BUS_OFF, samples[2].ControllerState)
+
+	assert.Nil(t, c.StopStream())
+	assert.Equal(t, 0, s.Streaming())
+}
@@ -0,0 +1,186 @@
+// Package isotp implements the ISO-TP transport protocol (ISO 15765-2) on classic CAN.
+//
+// Dial uses the kernel CAN_ISOTP sockets if the kernel supports them and falls back to the userspace
+// implementation on top of a socketcan.RawInterface otherwise.
+package isotp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"golang.org/x/sys/unix"
+)
+
+// AddressingMode defines how the ISO-TP addresses are mapped to CAN frames
+type AddressingMode int
+
+const (
+	// AddressingNormal uses the CAN ID only
+	AddressingNormal AddressingMode = iota
+	// AddressingExtended puts the target address (N_TA) into the first data byte of each frame
+	AddressingExtended
+	// AddressingMixed puts the address extension (N_AE) into the first data byte of each frame.
+	// The address extension is the same in both directions.
+	AddressingMixed
+)
+
+const (
+	// MaxMessageLen is the maximum length of an ISO-TP message on classic CAN
+	MaxMessageLen = 4095
+	// DefaultTimeout is the default time to wait for a flow control or consecutive frame (N_Bs, N_Cr)
+	DefaultTimeout = time.Second
+)
+
+var (
+	// ErrTimeout is returned if the peer didn't send a flow control or consecutive frame in time
+	ErrTimeout = errors.New("isotp timeout")
+	// ErrOverflow is returned by Send if the peer can't receive a message of this length
+	ErrOverflow = errors.New("isotp receiver buffer overflow")
+	// ErrWrongSequenceNumber is returned by Receive if a consecutive frame has been lost
+	ErrWrongSequenceNumber = errors.New("isotp wrong sequence number")
+	// ErrClosed is returned when the connection has been closed
+	ErrClosed = errors.New("isotp connection closed")
+	// ErrReceiveOverflow is returned by Receive of the userspace implementation if received messages have been
+	// dropped because Receive wasn't called often enough. The connection continues to receive.
+	ErrReceiveOverflow = errors.New("isotp receive queue overflow")
+)
+
+// Config defines an ISO-TP connection
+type Config struct {
+	// CAN ID of the frames sent to the peer
+	TxID uint32
+	// CAN ID of the frames received from the peer
+	RxID uint32
+	// TxID and RxID are 29 bit IDs
+	Extended bool
+
+	Addressing AddressingMode
+	// first data byte of sent frames with AddressingExtended or AddressingMixed
+	TxExtAddress uint8
+	// first data byte of received frames with AddressingExtended. Must be TxExtAddress with AddressingMixed
+	RxExtAddress uint8
+
+	// block size announced to the sender: number of consecutive frames between flow control frames, 0: no limit
+	BlockSize uint8
+	// minimum separation time between consecutive frames announced to the sender
+	STmin time.Duration
+
+	// pad all sent frames to 8 bytes with PadByte
+	Padding bool
+	PadByte uint8
+
+	// time to wait for a flow control or consecutive frame from the peer. 0: DefaultTimeout.
+	// Kernel CAN_ISOTP sockets always use 1s.
+	Timeout time.Duration
+}
+
+// Conn is an ISO-TP connection
+type Conn interface {
+	// Send sends a message. Blocks until the last frame has been sent.
+	Send(data []byte) error
+	// Receive receives a message.
+	// Blocking read
+	Receive() ([]byte, error)
+	// SetReceiveTimeout sets the maximum time Receive blocks.
+	// If the timeout expires, Receive returns socketcan.ErrReceiveTimeout. 0 means no timeout.
+	SetReceiveTimeout(d time.Duration) error
+	Close() error
+}
+
+// Dial opens an ISO-TP connection on the CAN interface.
+// It uses a kernel CAN_ISOTP socket if available, otherwise the userspace implementation.
+func Dial(interfaceName string, cfg Config) (Conn, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	c, err := newKernelConn(interfaceName, cfg)
+	if err == nil {
+		return c, nil
+	}
+	if !errors.Is(err, errNoKernelSupport) {
+		return nil, err
+	}
+	return DialUserspace(interfaceName, cfg)
+}
+
+// DialUserspace opens an ISO-TP connection on the CAN interface using the userspace implementation
+func DialUserspace(interfaceName string, cfg Config) (Conn, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	dev, err := socketcan.NewRawInterface(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	err = dev.SetFilters([]socketcan.CANFilter{{ID: cfg.rawRxID(), Mask: unix.CAN_EFF_FLAG | unix.CAN_RTR_FLAG | unix.CAN_EFF_MASK}})
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	c := newUserspaceConn(dev, cfg)
+	c.ownDev = dev
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	if c.Addressing == AddressingMixed && c.TxExtAddress != c.RxExtAddress {
+		return errors.New("mixed addressing requires the same address extension in both directions")
+	}
+	if c.Addressing < AddressingNormal || c.Addressing > AddressingMixed {
+		return fmt.Errorf("invalid addressing mode %d", c.Addressing)
+	}
+	return nil
+}
+
+func (c *Config) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+// rawRxID returns RxID with the EFF flag, if required
+func (c *Config) rawRxID() uint32 {
+	if c.Extended {
+		return c.RxID | unix.CAN_EFF_FLAG
+	}
+	return c.RxID
+}
+
+// rawTxID returns TxID with the EFF flag, if required
+func (c *Config) rawTxID() uint32 {
+	if c.Extended {
+		return c.TxID | unix.CAN_EFF_FLAG
+	}
+	return c.TxID
+}
+
+// encodeSTmin converts d into the STmin byte of a flow control frame
+func encodeSTmin(d time.Duration) uint8 {
+	switch {
+	case d <= 0:
+		return 0
+	case d < time.Millisecond:
+		us := d / (100 * time.Microsecond)
+		if us == 0 {
+			us = 1
+		}
+		return 0xF0 + uint8(us)
+	case d > 127*time.Millisecond:
+		return 127
+	}
+	return uint8(d / time.Millisecond)
+}
+
+// decodeSTmin converts the STmin byte of a flow control frame. Reserved values are treated as 127ms.
+func decodeSTmin(b uint8) time.Duration {
+	switch {
+	case b <= 0x7F:
+		return time.Duration(b) * time.Millisecond
+	case b >= 0xF1 && b <= 0xF9:
+		return time.Duration(b-0xF0) * 100 * time.Microsecond
+	}
+	return 127 * time.Millisecond
+}
@@ -0,0 +1,251 @@
+package isotp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"github.com/stretchr/testify/assert"
+)
+
+// memDevice is an in-memory FrameDevice. Frames sent are received by its peer.
+type memDevice struct {
+	rx     chan *socketcan.CANFrame
+	peer   *memDevice
+	closed chan struct{}
+
+	mu   sync.Mutex
+	sent []*socketcan.CANFrame
+}
+
+func newMemDevicePair() (*memDevice, *memDevice) {
+	a := &memDevice{rx: make(chan *socketcan.CANFrame, 256), closed: make(chan struct{})}
+	b := &memDevice{rx: make(chan *socketcan.CANFrame, 256), closed: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (d *memDevice) Send(f *socketcan.CANFrame) error {
+	d.mu.Lock()
+	d.sent = append(d.sent, f)
+	d.mu.Unlock()
+	d.peer.rx <- f
+	return nil
+}
+
+func (d *memDevice) Receive() (*socketcan.CANFrame, error) {
+	select {
+	case f := <-d.rx:
+		return f, nil
+	case <-d.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func (d *memDevice) close() {
+	close(d.closed)
+}
+
+func (d *memDevice) sentFrames() []*socketcan.CANFrame {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*socketcan.CANFrame(nil), d.sent...)
+}
+
+// newConnPair creates two connected userspace connections. cfgB is derived from cfgA with swapped IDs and addresses.
+func newConnPair(t *testing.T, cfgA Config, cfgB Config) (Conn, Conn, *memDevice, *memDevice) {
+	devA, devB := newMemDevicePair()
+	a, err := NewConn(devA, cfgA)
+	assert.Nil(t, err)
+	b, err := NewConn(devB, cfgB)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+		devA.close()
+		devB.close()
+	})
+	a.SetReceiveTimeout(2 * time.Second)
+	b.SetReceiveTimeout(2 * time.Second)
+	return a, b, devA, devB
+}
+
+func testMessage(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestSingleFrameWithPadding(t *testing.T) {
+	a, b, devA, _ := newConnPair(t,
+		Config{TxID: 0x7E0, RxID: 0x7E8, Padding: true, PadByte: 0xCC},
+		Config{TxID: 0x7E8, RxID: 0x7E0})
+
+	assert.Nil(t, a.Send([]byte{0x3E, 0x00}))
+	data, err := b.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x3E, 0x00}, data)
+
+	sent := devA.sentFrames()
+	assert.Equal(t, 1, len(sent))
+	assert.Equal(t, uint8(8), sent[0].DLC)
+	assert.Equal(t, []byte{0x02, 0x3E, 0x00, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC}, sent[0].Data)
+}
+
+func TestSegmentedMessage(t *testing.T) {
+	a, b, _, devB := newConnPair(t,
+		Config{TxID: 0x7E0, RxID: 0x7E8},
+		Config{TxID: 0x7E8, RxID: 0x7E0, BlockSize: 2, STmin: time.Millisecond})
+
+	msg := testMessage(100)
+	assert.Nil(t, a.Send(msg))
+	data, err := b.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, msg, data)
+
+	// first frame carries 6 bytes, 14 consecutive frames carry the rest, flow control after each block of 2
+	fc := devB.sentFrames()
+	assert.Equal(t, 7, len(fc))
+	assert.Equal(t, []byte{0x30, 2, 1}, fc[0].Data)
+
+	// and back, without padding the last frame is short
+	msg = testMessage(4095)
+	assert.Nil(t, b.Send(msg))
+	data, err = a.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, msg, data)
+}
+
+func TestExtendedAddressing(t *testing.T) {
+	a, b, devA, devB := newConnPair(t,
+		Config{TxID: 0x18DA10F1, RxID: 0x18DAF110, Extended: true, Addressing: AddressingExtended, TxExtAddress: 0x10, RxExtAddress: 0xF1},
+		Config{TxID: 0x18DAF110, RxID: 0x18DA10F1, Extended: true, Addressing: AddressingExtended, TxExtAddress: 0xF1, RxExtAddress: 0x10})
+
+	// frames for other addresses are ignored
+	devA.Send(&socketcan.CANFrame{ID: 0x18DA10F1, Extended: true, DLC: 3, Data: []byte{0x22, 0x01, 0xAA}})
+
+	msg := testMessage(20)
+	assert.Nil(t, a.Send(msg))
+	data, err := b.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, msg, data)
+
+	for _, f := range devA.sentFrames()[1:] {
+		assert.Equal(t, uint8(0x10), f.Data[0])
+	}
+	for _, f := range devB.sentFrames() {
+		assert.Equal(t, uint8(0xF1), f.Data[0])
+	}
+
+	_, err = NewConn(devA, Config{Addressing: AddressingMixed, TxExtAddress: 1, RxExtAddress: 2})
+	assert.NotNil(t, err)
+}
+
+func TestSendTimeout(t *testing.T) {
+	devA, devB := newMemDevicePair()
+	defer devA.close()
+	defer devB.close()
+	a, err := NewConn(devA, Config{TxID: 0x7E0, RxID: 0x7E8, Timeout: 50 * time.Millisecond})
+	assert.Nil(t, err)
+	defer a.Close()
+
+	// no peer sends flow control
+	assert.Equal(t, ErrTimeout, a.Send(testMessage(10)))
+
+	// overflow
+	devB.Send(&socketcan.CANFrame{ID: 0x7E8, DLC: 3, Data: []byte{0x32, 0, 0}})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		devB.Send(&socketcan.CANFrame{ID: 0x7E8, DLC: 3, Data: []byte{0x32, 0, 0}})
+	}()
+	assert.Equal(t, ErrOverflow, a.Send(testMessage(10)))
+}
+
+func TestReceiveErrors(t *testing.T) {
+	devA, devB := newMemDevicePair()
+	defer devA.close()
+	defer devB.close()
+	b, err := NewConn(devB, Config{TxID: 0x7E8, RxID: 0x7E0, Timeout: 50 * time.Millisecond})
+	assert.Nil(t, err)
+	defer b.Close()
+	b.SetReceiveTimeout(time.Second)
+
+	// first frame, then a consecutive frame is lost
+	devA.Send(&socketcan.CANFrame{ID: 0x7E0, DLC: 8, Data: []byte{0x10, 20, 0, 1, 2, 3, 4, 5}})
+	devA.Send(&socketcan.CANFrame{ID: 0x7E0, DLC: 8, Data: []byte{0x22, 6, 7, 8, 9, 10, 11, 12}})
+	_, err = b.Receive()
+	assert.Equal(t, ErrWrongSequenceNumber, err)
+
+	// first frame without consecutive frames
+	devA.Send(&socketcan.CANFrame{ID: 0x7E0, DLC: 8, Data: []byte{0x10, 20, 0, 1, 2, 3, 4, 5}})
+	_, err = b.Receive()
+	assert.Equal(t, ErrTimeout, err)
+
+	b.SetReceiveTimeout(20 * time.Millisecond)
+	_, err = b.Receive()
+	assert.Equal(t, socketcan.ErrReceiveTimeout, err)
+}
+
+func TestSTmin(t *testing.T) {
+	for _, tc := range []struct {
+		d time.Duration
+		b uint8
+	}{
+		{0, 0},
+		{5 * time.Millisecond, 5},
+		{127 * time.Millisecond, 127},
+		{100 * time.Microsecond, 0xF1},
+		{900 * time.Microsecond, 0xF9},
+	} {
+		assert.Equal(t, tc.b, encodeSTmin(tc.d))
+		assert.Equal(t, tc.d, decodeSTmin(tc.b))
+	}
+	assert.Equal(t, uint8(127), encodeSTmin(time.Second))
+	assert.Equal(t, 127*time.Millisecond, decodeSTmin(0x80))
+}
+
+func TestDialVcan(t *testing.T) {
+	a, err := Dial("vcan0", Config{TxID: 0x7E0, RxID: 0x7E8})
+	if err != nil {
+		t.Skipf("vcan0 not available: %v", err)
+	}
+	defer a.Close()
+	b, err := DialUserspace("vcan0", Config{TxID: 0x7E8, RxID: 0x7E0, BlockSize: 4})
+	assert.Nil(t, err)
+	defer b.Close()
+	b.SetReceiveTimeout(2 * time.Second)
+
+	msg := testMessage(200)
+	assert.Nil(t, a.Send(msg))
+	data, err := b.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, msg, data)
+}
+
+func TestSendWhileReceiveQueueFull(t *testing.T) {
+	a, b, _, _ := newConnPair(t,
+		Config{TxID: 0x7E0, RxID: 0x7E8},
+		Config{TxID: 0x7E8, RxID: 0x7E0})
+
+	// a doesn't call Receive
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, b.Send([]byte{byte(i)}))
+	}
+
+	// a still processes the flow control frames of b
+	msg := testMessage(100)
+	assert.Nil(t, a.Send(msg))
+	data, err := b.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, msg, data)
+
+	_, err = a.Receive()
+	assert.Equal(t, ErrReceiveOverflow, err)
+	data, err = a.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0}, data)
+}
@@ -0,0 +1,129 @@
+package isotp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"golang.org/x/sys/unix"
+)
+
+// errNoKernelSupport is returned by newKernelConn if the kernel has no CAN_ISOTP support.
+// Dial falls back to the userspace implementation only on this error.
+var errNoKernelSupport = errors.New("no kernel support for CAN_ISOTP")
+
+// socket options and flags, see linux/can/isotp.h
+const (
+	solCANISOTP        = unix.SOL_CAN_BASE + unix.CAN_ISOTP
+	canISOTPOpts       = 1
+	canISOTPRecvFC     = 2
+	canISOTPExtendAddr = 0x002
+	canISOTPTxPadding  = 0x004
+	canISOTPRxExtAddr  = 0x200
+	canISOTPWaitTxDone = 0x400
+	// size of the receive buffer, the kernel accepts messages up to its max_pdu_size
+	kernelRxBufSize = 1 << 16
+)
+
+// kernelConn is an ISO-TP connection using a kernel CAN_ISOTP socket
+type kernelConn struct {
+	socket int
+}
+
+func newKernelConn(interfaceName string, cfg Config) (*kernelConn, error) {
+	socket, err := unix.Socket(unix.AF_CAN, unix.SOCK_DGRAM, unix.CAN_ISOTP)
+	if err == unix.EPROTONOSUPPORT || err == unix.EAFNOSUPPORT {
+		return nil, fmt.Errorf("%w: %v", errNoKernelSupport, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't create CAN_ISOTP socket: %w", err)
+	}
+	err = setKernelOptions(socket, cfg)
+	if err != nil {
+		unix.Close(socket)
+		return nil, err
+	}
+	ifc, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		unix.Close(socket)
+		return nil, err
+	}
+	addr := &unix.SockaddrCAN{Ifindex: ifc.Index, RxID: cfg.rawRxID(), TxID: cfg.rawTxID()}
+	if err = unix.Bind(socket, addr); err != nil {
+		unix.Close(socket)
+		return nil, err
+	}
+	return &kernelConn{socket: socket}, nil
+}
+
+// setKernelOptions sets struct can_isotp_options and struct can_isotp_fc_options
+func setKernelOptions(socket int, cfg Config) error {
+	opts := make([]byte, 12)
+	flags := uint32(canISOTPWaitTxDone)
+	if cfg.Addressing != AddressingNormal {
+		flags |= canISOTPExtendAddr | canISOTPRxExtAddr
+		opts[8] = cfg.TxExtAddress
+		opts[11] = cfg.RxExtAddress
+	}
+	if cfg.Padding {
+		flags |= canISOTPTxPadding
+		opts[9] = cfg.PadByte
+	}
+	binary.LittleEndian.PutUint32(opts[0:4], flags)
+	if err := unix.SetsockoptString(socket, solCANISOTP, canISOTPOpts, string(opts)); err != nil {
+		return fmt.Errorf("can't set isotp options: %v", err)
+	}
+	fcOpts := []byte{cfg.BlockSize, encodeSTmin(cfg.STmin), 0}
+	if err := unix.SetsockoptString(socket, solCANISOTP, canISOTPRecvFC, string(fcOpts)); err != nil {
+		return fmt.Errorf("can't set isotp flow control options: %v", err)
+	}
+	return nil
+}
+
+// Send sends a message. Blocks until the last frame has been sent.
+func (c *kernelConn) Send(data []byte) error {
+	_, err := unix.Write(c.socket, data)
+	return kernelError(err)
+}
+
+// Receive receives a message.
+// Blocking read
+func (c *kernelConn) Receive() ([]byte, error) {
+	buf := make([]byte, kernelRxBufSize)
+	n, err := unix.Read(c.socket, buf)
+	if err == unix.EAGAIN {
+		return nil, socketcan.ErrReceiveTimeout
+	}
+	if err != nil {
+		return nil, kernelError(err)
+	}
+	return buf[:n], nil
+}
+
+// SetReceiveTimeout sets the maximum time Receive blocks (SO_RCVTIMEO).
+// If the timeout expires, Receive returns socketcan.ErrReceiveTimeout. 0 means no timeout.
+func (c *kernelConn) SetReceiveTimeout(d time.Duration) error {
+	tv := unix.NsecToTimeval(d.Nanoseconds())
+	return unix.SetsockoptTimeval(c.socket, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+}
+
+// Close closes the socket
+func (c *kernelConn) Close() error {
+	return unix.Close(c.socket)
+}
+
+// kernelError maps the errors the kernel reports for protocol failures to the errors of this package
+func kernelError(err error) error {
+	switch err {
+	case unix.ECOMM:
+		return ErrTimeout
+	case unix.EILSEQ:
+		return ErrWrongSequenceNumber
+	case unix.EMSGSIZE:
+		return ErrOverflow
+	}
+	return err
+}
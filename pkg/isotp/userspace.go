@@ -0,0 +1,413 @@
+package isotp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// protocol control information types (high nibble of the first PCI byte)
+const (
+	pciSingleFrame      = 0x0
+	pciFirstFrame       = 0x1
+	pciConsecutiveFrame = 0x2
+	pciFlowControl      = 0x3
+)
+
+// flow status of flow control frames
+const (
+	flowStatusContinue = 0x0
+	flowStatusWait     = 0x1
+	flowStatusOverflow = 0x2
+)
+
+// FrameDevice sends and receives CAN frames, e.g. a socketcan.RawInterface
+type FrameDevice interface {
+	Send(f *socketcan.CANFrame) error
+	// Receive may return socketcan.ErrReceiveTimeout, the connection then continues to receive
+	Receive() (*socketcan.CANFrame, error)
+}
+
+type rxResult struct {
+	data []byte
+	err  error
+}
+
+// userspaceConn implements ISO-TP on top of a FrameDevice
+type userspaceConn struct {
+	dev    FrameDevice
+	ownDev *socketcan.RawInterface // closed by Close, if not nil
+	cfg    Config
+	offset int // 1 with extended or mixed addressing, the address byte precedes the PCI
+
+	txMu       sync.Mutex // serializes Send
+	devMu      sync.Mutex // serializes frames of Send and flow control frames of the receiver
+	frames     chan *socketcan.CANFrame
+	fc         chan []byte // flow control frames from the peer
+	rx         chan rxResult
+	done       chan struct{}
+	readerDone chan struct{}
+	closeOnce  sync.Once
+	overflow   int32 // 1 if messages have been dropped since the last ErrReceiveOverflow
+
+	mu        sync.Mutex
+	rxTimeout time.Duration
+
+	// receiver state, only accessed by run
+	rxBuf   []byte
+	rxSize  int
+	rxSN    uint8
+	rxBlock int
+}
+
+// NewConn creates an ISO-TP connection using the userspace implementation on dev.
+// The connection receives all frames from dev, frames with other IDs are ignored.
+// Close doesn't close dev. The caller must close dev afterwards to end the pending dev.Receive.
+func NewConn(dev FrameDevice, cfg Config) (Conn, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return newUserspaceConn(dev, cfg), nil
+}
+
+func newUserspaceConn(dev FrameDevice, cfg Config) *userspaceConn {
+	c := &userspaceConn{
+		dev:        dev,
+		cfg:        cfg,
+		frames:     make(chan *socketcan.CANFrame, 16),
+		fc:         make(chan []byte, 1),
+		rx:         make(chan rxResult, 16),
+		done:       make(chan struct{}),
+		readerDone: make(chan struct{}),
+	}
+	if cfg.Addressing != AddressingNormal {
+		c.offset = 1
+	}
+	go c.readFrames()
+	go c.run()
+	return c
+}
+
+// Send sends a message. Blocks until the last frame has been sent.
+func (c *userspaceConn) Send(data []byte) error {
+	if len(data) == 0 || len(data) > MaxMessageLen {
+		return fmt.Errorf("invalid message length %d (1..%d)", len(data), MaxMessageLen)
+	}
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	if len(data) <= 7-c.offset {
+		return c.sendFrame(append([]byte{pciSingleFrame<<4 | byte(len(data))}, data...))
+	}
+
+	// discard flow control frames not meant for this message
+	select {
+	case <-c.fc:
+	default:
+	}
+
+	n := 6 - c.offset
+	ff := append([]byte{pciFirstFrame<<4 | byte(len(data)>>8), byte(len(data))}, data[:n]...)
+	if err := c.sendFrame(ff); err != nil {
+		return err
+	}
+	data = data[n:]
+
+	sn := uint8(1)
+	for len(data) > 0 {
+		blockSize, stMin, err := c.waitFlowControl()
+		if err != nil {
+			return err
+		}
+		for sent := 0; len(data) > 0 && (blockSize == 0 || sent < blockSize); sent++ {
+			if sent > 0 {
+				time.Sleep(stMin)
+			}
+			n := 7 - c.offset
+			if n > len(data) {
+				n = len(data)
+			}
+			if err := c.sendFrame(append([]byte{pciConsecutiveFrame<<4 | sn}, data[:n]...)); err != nil {
+				return err
+			}
+			data = data[n:]
+			sn = (sn + 1) & 0x0F
+		}
+	}
+	return nil
+}
+
+// Receive receives a message.
+// If messages have been dropped because the receive queue was full, Receive returns ErrReceiveOverflow once
+// and then continues with the queued messages.
+// Blocking read
+func (c *userspaceConn) Receive() ([]byte, error) {
+	if atomic.CompareAndSwapInt32(&c.overflow, 1, 0) {
+		return nil, ErrReceiveOverflow
+	}
+	c.mu.Lock()
+	d := c.rxTimeout
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case r := <-c.rx:
+		return r.data, r.err
+	case <-timeout:
+		return nil, socketcan.ErrReceiveTimeout
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// SetReceiveTimeout sets the maximum time Receive blocks.
+// If the timeout expires, Receive returns socketcan.ErrReceiveTimeout. 0 means no timeout.
+func (c *userspaceConn) SetReceiveTimeout(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rxTimeout = d
+	return nil
+}
+
+// Close stops the connection. If the connection has been opened by DialUserspace, the CAN socket is closed.
+func (c *userspaceConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.ownDev != nil {
+			// unblocks the reader
+			err = c.ownDev.Close()
+			<-c.readerDone
+		}
+	})
+	return err
+}
+
+// readFrames passes the frames from dev to run
+func (c *userspaceConn) readFrames() {
+	defer close(c.readerDone)
+	for {
+		f, err := c.dev.Receive()
+		if errors.Is(err, socketcan.ErrReceiveTimeout) {
+			select {
+			case <-c.done:
+				return
+			default:
+				continue
+			}
+		}
+		if err != nil {
+			// the reader terminates, so Receive may wait for the error
+			select {
+			case c.rx <- rxResult{err: err}:
+			case <-c.done:
+			}
+			return
+		}
+		select {
+		case c.frames <- f:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// run handles the received frames and the consecutive frame timeout (N_Cr)
+func (c *userspaceConn) run() {
+	timer := time.NewTimer(c.cfg.timeout())
+	stopTimer(timer)
+	receiving := false
+	for {
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case f := <-c.frames:
+			// a timeout that expired meanwhile must not abort the reception
+			stopTimer(timer)
+			receiving = c.handleFrame(f, receiving)
+			if receiving {
+				timer.Reset(c.cfg.timeout())
+			}
+		case <-timer.C:
+			receiving = false
+			c.deliver(rxResult{err: ErrTimeout})
+		}
+	}
+}
+
+// stopTimer stops timer and drains its channel, so that it can be reset
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// handleFrame processes a received frame. receiving is true while a segmented message is received.
+// Returns the new value of receiving.
+func (c *userspaceConn) handleFrame(f *socketcan.CANFrame, receiving bool) bool {
+	data := c.payload(f)
+	if len(data) == 0 {
+		return receiving
+	}
+	switch data[0] >> 4 {
+	case pciSingleFrame:
+		n := int(data[0] & 0x0F)
+		if n == 0 || n > len(data)-1 {
+			return receiving
+		}
+		// a new message aborts the reception of a segmented message
+		c.deliver(rxResult{data: append([]byte(nil), data[1:1+n]...)})
+		return false
+
+	case pciFirstFrame:
+		if len(data) < 2 {
+			return receiving
+		}
+		n := int(data[0]&0x0F)<<8 | int(data[1])
+		if n <= 7-c.offset {
+			return receiving
+		}
+		c.rxBuf = append(make([]byte, 0, n), data[2:]...)
+		c.rxSize = n
+		c.rxSN = 1
+		c.rxBlock = 0
+		c.sendFlowControl()
+		return true
+
+	case pciConsecutiveFrame:
+		if !receiving {
+			return false
+		}
+		if data[0]&0x0F != c.rxSN {
+			c.deliver(rxResult{err: ErrWrongSequenceNumber})
+			return false
+		}
+		c.rxSN = (c.rxSN + 1) & 0x0F
+		chunk := data[1:]
+		if need := c.rxSize - len(c.rxBuf); len(chunk) > need {
+			chunk = chunk[:need]
+		}
+		c.rxBuf = append(c.rxBuf, chunk...)
+		if len(c.rxBuf) == c.rxSize {
+			c.deliver(rxResult{data: c.rxBuf})
+			c.rxBuf = nil
+			return false
+		}
+		c.rxBlock++
+		if c.cfg.BlockSize != 0 && c.rxBlock == int(c.cfg.BlockSize) {
+			c.rxBlock = 0
+			c.sendFlowControl()
+		}
+		return true
+
+	case pciFlowControl:
+		select {
+		case c.fc <- data:
+		default:
+		}
+	}
+	return receiving
+}
+
+// payload returns the PCI and data of f, or nil if f doesn't belong to this connection
+func (c *userspaceConn) payload(f *socketcan.CANFrame) []byte {
+	if f.ID != c.cfg.RxID || f.Extended != c.cfg.Extended || f.RTR || f.FD {
+		return nil
+	}
+	data := f.Data[:f.DLC]
+	if c.offset == 0 {
+		return data
+	}
+	if len(data) < 1 || data[0] != c.cfg.RxExtAddress {
+		return nil
+	}
+	return data[1:]
+}
+
+// waitFlowControl waits for a flow control frame that allows to continue (N_Bs)
+func (c *userspaceConn) waitFlowControl() (blockSize int, stMin time.Duration, err error) {
+	timer := time.NewTimer(c.cfg.timeout())
+	defer timer.Stop()
+	for {
+		select {
+		case data := <-c.fc:
+			if len(data) < 3 {
+				continue
+			}
+			switch data[0] & 0x0F {
+			case flowStatusContinue:
+				return int(data[1]), decodeSTmin(data[2]), nil
+			case flowStatusWait:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(c.cfg.timeout())
+			case flowStatusOverflow:
+				return 0, 0, ErrOverflow
+			}
+		case <-timer.C:
+			return 0, 0, ErrTimeout
+		case <-c.done:
+			return 0, 0, ErrClosed
+		}
+	}
+}
+
+func (c *userspaceConn) sendFlowControl() {
+	err := c.sendFrame([]byte{pciFlowControl<<4 | flowStatusContinue, c.cfg.BlockSize, encodeSTmin(c.cfg.STmin)})
+	if err != nil {
+		c.deliver(rxResult{err: fmt.Errorf("can't send flow control: %v", err)})
+	}
+}
+
+// sendFrame sends pdu (PCI and data) to the peer, preceded by the address byte and padded as configured
+func (c *userspaceConn) sendFrame(pdu []byte) error {
+	data := make([]byte, 0, socketcan.CANMaxDLen)
+	if c.offset != 0 {
+		data = append(data, c.cfg.TxExtAddress)
+	}
+	data = append(data, pdu...)
+	if c.cfg.Padding {
+		for len(data) < socketcan.CANMaxDLen {
+			data = append(data, c.cfg.PadByte)
+		}
+	}
+	f := &socketcan.CANFrame{
+		ID:       c.cfg.TxID,
+		Extended: c.cfg.Extended,
+		DLC:      uint8(len(data)),
+		Data:     data,
+	}
+	c.devMu.Lock()
+	defer c.devMu.Unlock()
+	return c.dev.Send(f)
+}
+
+// deliver passes r to Receive. If the receive queue is full, r is dropped and Receive returns ErrReceiveOverflow:
+// run must not wait for the application, it also forwards the flow control frames to Send.
+func (c *userspaceConn) deliver(r rxResult) {
+	select {
+	case c.rx <- r:
+	default:
+		atomic.StoreInt32(&c.overflow, 1)
+	}
+}
@@ -0,0 +1,396 @@
+package j1939
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// addressClaimTimeout is the time to wait for contending claims after sending an address claim
+const addressClaimTimeout = 250 * time.Millisecond
+
+// Config defines a J1939 node
+type Config struct {
+	// NAME of the node. If 0, Address is used without address claim.
+	Name Name
+	// preferred source address. If the address is taken by a node with a higher priority NAME,
+	// an arbitrary address capable node claims an address in the range 128..247.
+	Address Address
+	// maximum length of received messages, 0 means DefaultMaxMessageLen
+	MaxMessageLen int
+}
+
+func (c Config) maxMessageLen() int {
+	if c.MaxMessageLen <= 0 {
+		return DefaultMaxMessageLen
+	}
+	if c.MaxMessageLen > MaxMessageLen {
+		return MaxMessageLen
+	}
+	return c.MaxMessageLen
+}
+
+// transport sends and receives complete messages, i.e. it implements TP and ETP
+type transport interface {
+	send(m *Message) error
+	// receive may return socketcan.ErrReceiveTimeout. It returns ErrClosed, when done is closed.
+	receive(done <-chan struct{}) (*Message, error)
+	// setAddress sets the source address of the node
+	setAddress(a Address) error
+	close() error
+}
+
+type rxResult struct {
+	msg *Message
+	err error
+}
+
+// Conn is a J1939 node on a CAN interface.
+// It keeps its address claimed: it answers requests for the address claim and defends its address
+// against nodes with a lower priority NAME.
+type Conn struct {
+	t    transport
+	name Name
+
+	rx         chan rxResult
+	done       chan struct{}
+	readerDone chan struct{}
+	reclaims   sync.WaitGroup // reclaims started by the reader
+	closeOnce  sync.Once
+	overflow   int32 // 1 if messages have been dropped since the last ErrOverflow
+
+	mu        sync.Mutex
+	addr      Address          // claimed address, AddressNull if none
+	claiming  Address          // address while it is claimed, AddressNull otherwise
+	lost      chan struct{}    // closed if a contending claim wins during claiming
+	others    map[Address]Name // addresses claimed by other nodes
+	rxTimeout time.Duration
+}
+
+// Dial creates a J1939 node on the CAN interface and claims its address.
+// It uses a kernel CAN_J1939 socket if available, otherwise the userspace implementation.
+func Dial(interfaceName string, cfg Config) (*Conn, error) {
+	t, err := newKernelTransport(interfaceName, cfg)
+	if err == nil {
+		return newConn(t, cfg)
+	}
+	if !errors.Is(err, errNoKernelSupport) {
+		return nil, err
+	}
+	return DialUserspace(interfaceName, cfg)
+}
+
+// DialUserspace creates a J1939 node on the CAN interface using the userspace implementation
+func DialUserspace(interfaceName string, cfg Config) (*Conn, error) {
+	dev, err := socketcan.NewRawInterface(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	t := newUserspaceTransport(dev, cfg.maxMessageLen())
+	t.ownDev = dev
+	return newConn(t, cfg)
+}
+
+// NewConn creates a J1939 node using the userspace implementation on dev and claims its address.
+// Close doesn't close dev. The caller must close dev afterwards to end the pending dev.Receive.
+func NewConn(dev FrameDevice, cfg Config) (*Conn, error) {
+	return newConn(newUserspaceTransport(dev, cfg.maxMessageLen()), cfg)
+}
+
+func newConn(t transport, cfg Config) (*Conn, error) {
+	c := &Conn{
+		t:          t,
+		name:       cfg.Name,
+		rx:         make(chan rxResult, 64),
+		done:       make(chan struct{}),
+		readerDone: make(chan struct{}),
+		addr:       AddressNull,
+		claiming:   AddressNull,
+		others:     make(map[Address]Name),
+	}
+	go c.readMessages()
+
+	var err error
+	if cfg.Name == 0 {
+		err = t.setAddress(cfg.Address)
+		c.mu.Lock()
+		c.addr = cfg.Address
+		c.mu.Unlock()
+	} else {
+		err = c.claimAddress(cfg.Address)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Address returns the claimed address, AddressNull if the node has no address
+func (c *Conn) Address() Address {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr
+}
+
+// Send sends a message from the address of the node.
+// Messages with more than 8 bytes are sent with BAM (broadcast), TP or ETP. Blocks until the transfer is complete.
+func (c *Conn) Send(m *Message) error {
+	addr := c.Address()
+	if addr == AddressNull {
+		return ErrNoAddress
+	}
+	out := *m
+	out.Source = addr
+	if !m.PGN.PDU1() {
+		out.Destination = AddressGlobal
+	}
+	return c.t.send(&out)
+}
+
+// Receive receives a message sent to the address of the node or to all nodes.
+// If messages have been dropped because the receive queue was full, Receive returns ErrOverflow once
+// and then continues with the queued messages.
+// Blocking read
+func (c *Conn) Receive() (*Message, error) {
+	if atomic.CompareAndSwapInt32(&c.overflow, 1, 0) {
+		return nil, ErrOverflow
+	}
+	c.mu.Lock()
+	d := c.rxTimeout
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case r := <-c.rx:
+		return r.msg, r.err
+	case <-timeout:
+		return nil, socketcan.ErrReceiveTimeout
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// SetReceiveTimeout sets the maximum time Receive blocks.
+// If the timeout expires, Receive returns socketcan.ErrReceiveTimeout. 0 means no timeout.
+func (c *Conn) SetReceiveTimeout(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rxTimeout = d
+	return nil
+}
+
+// Close stops the node
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		<-c.readerDone
+		// a reclaim must not use the transport after it has been closed
+		c.reclaims.Wait()
+		err = c.t.close()
+	})
+	return err
+}
+
+// readMessages handles the address claim messages and passes the messages for this node to Receive
+func (c *Conn) readMessages() {
+	defer close(c.readerDone)
+	for {
+		m, err := c.t.receive(c.done)
+		if errors.Is(err, socketcan.ErrReceiveTimeout) {
+			select {
+			case <-c.done:
+				return
+			default:
+				continue
+			}
+		}
+		if err == ErrMessageTooLong {
+			c.deliver(rxResult{err: err})
+			continue
+		}
+		if err != nil {
+			// the reader terminates, so Receive may wait for the error
+			select {
+			case c.rx <- rxResult{err: err}:
+			case <-c.done:
+			}
+			return
+		}
+		if c.name != 0 {
+			switch m.PGN {
+			case PGNAddressClaimed:
+				c.handleAddressClaim(m)
+			case PGNRequest:
+				c.handleRequest(m)
+			}
+		}
+		if m.Destination != AddressGlobal && m.Destination != c.Address() {
+			continue
+		}
+		c.deliver(rxResult{msg: m})
+	}
+}
+
+// deliver passes r to Receive. If the receive queue is full, r is dropped and Receive returns ErrOverflow:
+// the address claim and the transport protocol must not wait for the application.
+func (c *Conn) deliver(r rxResult) {
+	select {
+	case c.rx <- r:
+	default:
+		atomic.StoreInt32(&c.overflow, 1)
+	}
+}
+
+// claimAddress claims preferred or, if the node is arbitrary address capable and preferred is taken,
+// another address in the range 128..247
+func (c *Conn) claimAddress(preferred Address) error {
+	candidates := []Address{preferred}
+	if c.name.ArbitraryAddressCapable() {
+		for a := Address(128); a <= 247; a++ {
+			if a != preferred {
+				candidates = append(candidates, a)
+			}
+		}
+	}
+	for _, a := range candidates {
+		c.mu.Lock()
+		if other, ok := c.others[a]; ok && other < c.name {
+			c.mu.Unlock()
+			continue
+		}
+		c.claiming = a
+		c.lost = make(chan struct{})
+		lost := c.lost
+		c.mu.Unlock()
+
+		if err := c.t.setAddress(a); err != nil {
+			return err
+		}
+		if err := c.sendAddressClaim(a); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(addressClaimTimeout):
+			c.mu.Lock()
+			won := c.claiming == a
+			if won {
+				c.addr = a
+				c.claiming = AddressNull
+			}
+			c.mu.Unlock()
+			if won {
+				return nil
+			}
+		case <-lost:
+		case <-c.done:
+			return ErrClosed
+		}
+	}
+	c.mu.Lock()
+	c.claiming = AddressNull
+	c.mu.Unlock()
+	c.cannotClaim()
+	return ErrAddressClaimFailed
+}
+
+// handleAddressClaim handles the address claim of another node
+func (c *Conn) handleAddressClaim(m *Message) {
+	if len(m.Data) < 8 || m.Source >= AddressNull {
+		return
+	}
+	name := Name(binary.LittleEndian.Uint64(m.Data))
+	if name == c.name {
+		return
+	}
+
+	c.mu.Lock()
+	for a, n := range c.others {
+		if n == name {
+			delete(c.others, a)
+		}
+	}
+	c.others[m.Source] = name
+
+	var defend, reclaim bool
+	switch {
+	case m.Source == c.claiming:
+		if name < c.name {
+			close(c.lost)
+			c.claiming = AddressNull
+		} else {
+			defend = true
+		}
+	case m.Source == c.addr:
+		if name < c.name {
+			c.addr = AddressNull
+			reclaim = true
+		} else {
+			defend = true
+		}
+	}
+	c.mu.Unlock()
+
+	if defend {
+		c.sendAddressClaim(m.Source)
+	}
+	if reclaim {
+		c.reclaims.Add(1)
+		go func() {
+			defer c.reclaims.Done()
+			// claims another address if arbitrary address capable, otherwise sends cannot claim
+			if err := c.claimAddress(m.Source); err != nil && err != ErrClosed {
+				c.deliver(rxResult{err: err})
+			}
+		}()
+	}
+}
+
+// handleRequest answers requests for the address claim
+func (c *Conn) handleRequest(m *Message) {
+	if len(m.Data) < 3 {
+		return
+	}
+	pgn := PGN(m.Data[0]) | PGN(m.Data[1])<<8 | PGN(m.Data[2])<<16
+	if pgn != PGNAddressClaimed {
+		return
+	}
+	addr := c.Address()
+	if m.Destination != AddressGlobal && m.Destination != addr {
+		return
+	}
+	if addr == AddressNull {
+		c.cannotClaim()
+		return
+	}
+	c.sendAddressClaim(addr)
+}
+
+func (c *Conn) sendAddressClaim(a Address) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(c.name))
+	return c.t.send(&Message{
+		PGN:         PGNAddressClaimed,
+		Priority:    DefaultPriority,
+		Source:      a,
+		Destination: AddressGlobal,
+		Data:        data,
+	})
+}
+
+// cannotClaim sends the address claim with the null address
+func (c *Conn) cannotClaim() {
+	if c.t.setAddress(AddressNull) == nil {
+		c.sendAddressClaim(AddressNull)
+	}
+}
@@ -0,0 +1,152 @@
+// Package j1939 implements SAE J1939 addressing, the address claim procedure (J1939-81) and
+// the transport protocols TP and ETP (J1939-21) on CAN.
+//
+// Dial uses the kernel CAN_J1939 sockets if the kernel supports them and falls back to the userspace
+// implementation on top of a socketcan.RawInterface otherwise.
+package j1939
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// PGN is a parameter group number (18 bit). For PDU1 PGNs, the PDU specific byte is 0.
+type PGN uint32
+
+// Address is a J1939 source or destination address
+type Address uint8
+
+// Name is the 64 bit NAME of a J1939 node. A lower NAME has a higher priority in the address claim.
+//
+// Bit layout: 63 arbitrary address capable, 60-62 industry group, 56-59 vehicle system instance,
+// 49-55 vehicle system, 40-47 function, 35-39 function instance, 32-34 ECU instance,
+// 21-31 manufacturer code, 0-20 identity number.
+type Name uint64
+
+const (
+	// AddressNull is the source address of a node that has no address (cannot claim)
+	AddressNull Address = 0xFE
+	// AddressGlobal is the destination address of broadcast messages
+	AddressGlobal Address = 0xFF
+)
+
+const (
+	// PGNRequest requests the PGN in the first 3 data bytes
+	PGNRequest PGN = 0xEA00
+	// PGNAddressClaimed claims the source address for the NAME in the data
+	PGNAddressClaimed PGN = 0xEE00
+	// PGNTPCM is the transport protocol connection management
+	PGNTPCM PGN = 0xEC00
+	// PGNTPDT is the transport protocol data transfer
+	PGNTPDT PGN = 0xEB00
+	// PGNETPCM is the extended transport protocol connection management
+	PGNETPCM PGN = 0xC800
+	// PGNETPDT is the extended transport protocol data transfer
+	PGNETPDT PGN = 0xC700
+)
+
+const (
+	// DefaultPriority is the default priority of messages
+	DefaultPriority = 6
+	// MaxTPLen is the maximum length of a message sent with TP. Longer messages are sent with ETP.
+	MaxTPLen = 1785
+	// MaxMessageLen is the maximum length of a message (ETP)
+	MaxMessageLen = 117440505
+	// DefaultMaxMessageLen is the default maximum length of received messages, see Config.MaxMessageLen
+	DefaultMaxMessageLen = 64 * 1024
+)
+
+var (
+	// ErrAddressClaimFailed is returned by Dial if no address could be claimed
+	ErrAddressClaimFailed = errors.New("j1939 address claim failed")
+	// ErrNoAddress is returned by Send if the node has lost its address
+	ErrNoAddress = errors.New("j1939 node has no address")
+	// ErrTimeout is returned by Send if the receiver didn't respond in time
+	ErrTimeout = errors.New("j1939 transport protocol timeout")
+	// ErrAborted is returned by Send if the receiver aborted the transfer
+	ErrAborted = errors.New("j1939 transport protocol aborted")
+	// ErrClosed is returned when the connection has been closed
+	ErrClosed = errors.New("j1939 connection closed")
+	// ErrMessageTooLong is returned by Receive if a received message exceeded Config.MaxMessageLen.
+	// The node continues to receive.
+	ErrMessageTooLong = errors.New("j1939 message too long")
+	// ErrOverflow is returned by Receive if received messages have been dropped because Receive wasn't called
+	// often enough. The node continues to receive.
+	ErrOverflow = errors.New("j1939 receive queue overflow")
+)
+
+// PDU1 returns true if the PGN is destination specific (PDU format < 240)
+func (p PGN) PDU1() bool {
+	return (p>>8)&0xFF < 240
+}
+
+// ArbitraryAddressCapable returns true if the node may claim any address in the range 128..247
+func (n Name) ArbitraryAddressCapable() bool {
+	return n>>63 != 0
+}
+
+// Message is a J1939 message
+type Message struct {
+	PGN PGN
+	// 0 (highest) .. 7 (lowest), e.g. DefaultPriority
+	Priority    uint8
+	Source      Address
+	Destination Address // AddressGlobal for broadcasts and PDU2 PGNs
+	Data        []byte
+}
+
+func (m *Message) String() string {
+	return fmt.Sprintf("pgn 0x%05X prio %d %02X->%02X [%d] % X", uint32(m.PGN), m.Priority, m.Source, m.Destination, len(m.Data), m.Data)
+}
+
+// ParseID splits a 29 bit CAN ID into the J1939 fields
+func ParseID(id uint32) (priority uint8, pgn PGN, destination Address, source Address) {
+	priority = uint8(id>>26) & 0x7
+	pgn = PGN(id>>8) & 0x3FFFF
+	if pgn.PDU1() {
+		destination = Address(pgn & 0xFF)
+		pgn &^= 0xFF
+	} else {
+		destination = AddressGlobal
+	}
+	return priority, pgn, destination, Address(id)
+}
+
+// MakeID builds a 29 bit CAN ID from the J1939 fields. destination is ignored for PDU2 PGNs.
+func MakeID(priority uint8, pgn PGN, destination Address, source Address) uint32 {
+	id := uint32(priority&0x7)<<26 | uint32(pgn&0x3FFFF)<<8 | uint32(source)
+	if pgn.PDU1() {
+		id = id&^0xFF00 | uint32(destination)<<8
+	}
+	return id
+}
+
+// FromFrame converts a single frame into a message
+func FromFrame(f *socketcan.CANFrame) (*Message, error) {
+	if !f.Extended || f.RTR {
+		return nil, errors.New("j1939 requires extended data frames")
+	}
+	priority, pgn, destination, source := ParseID(f.ID)
+	return &Message{
+		PGN:         pgn,
+		Priority:    priority,
+		Source:      source,
+		Destination: destination,
+		Data:        append([]byte(nil), f.Data[:f.DLC]...),
+	}, nil
+}
+
+// Frame converts a message with up to 8 data bytes into a single frame
+func (m *Message) Frame() (*socketcan.CANFrame, error) {
+	if len(m.Data) > socketcan.CANMaxDLen {
+		return nil, fmt.Errorf("message with %d bytes requires the transport protocol", len(m.Data))
+	}
+	return &socketcan.CANFrame{
+		ID:       MakeID(m.Priority, m.PGN, m.Destination, m.Source),
+		Extended: true,
+		DLC:      uint8(len(m.Data)),
+		Data:     m.Data,
+	}, nil
+}
@@ -0,0 +1,394 @@
+package j1939
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"github.com/stretchr/testify/assert"
+)
+
+// memBus connects in-memory FrameDevices. A frame sent by one device is received by all others.
+type memBus struct {
+	mu      sync.Mutex
+	devices []*memDevice
+}
+
+type memDevice struct {
+	bus    *memBus
+	rx     chan *socketcan.CANFrame
+	closed chan struct{}
+}
+
+func (b *memBus) newDevice(t *testing.T) *memDevice {
+	d := &memDevice{bus: b, rx: make(chan *socketcan.CANFrame, 1024), closed: make(chan struct{})}
+	b.mu.Lock()
+	b.devices = append(b.devices, d)
+	b.mu.Unlock()
+	t.Cleanup(func() { close(d.closed) })
+	return d
+}
+
+func (d *memDevice) Send(f *socketcan.CANFrame) error {
+	d.bus.mu.Lock()
+	defer d.bus.mu.Unlock()
+	for _, other := range d.bus.devices {
+		if other != d {
+			other.rx <- f
+		}
+	}
+	return nil
+}
+
+func (d *memDevice) Receive() (*socketcan.CANFrame, error) {
+	select {
+	case f := <-d.rx:
+		return f, nil
+	case <-d.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func newTestConn(t *testing.T, bus *memBus, cfg Config) *Conn {
+	c, err := NewConn(bus.newDevice(t), cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+	c.SetReceiveTimeout(3 * time.Second)
+	return c
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// receivePGN receives messages until a message with pgn arrives
+func receivePGN(t *testing.T, c *Conn, pgn PGN) *Message {
+	for {
+		m, err := c.Receive()
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		if m.PGN == pgn {
+			return m
+		}
+	}
+}
+
+func TestID(t *testing.T) {
+	// EEC1 (PDU2) from 0x00, priority 3
+	priority, pgn, da, sa := ParseID(0x0CF00400)
+	assert.Equal(t, uint8(3), priority)
+	assert.Equal(t, PGN(0xF004), pgn)
+	assert.Equal(t, AddressGlobal, da)
+	assert.Equal(t, Address(0x00), sa)
+	assert.Equal(t, uint32(0x0CF00400), MakeID(3, 0xF004, 0x12, 0x00))
+
+	// request (PDU1) from 0xF9 to 0x17
+	priority, pgn, da, sa = ParseID(0x18EA17F9)
+	assert.Equal(t, uint8(6), priority)
+	assert.Equal(t, PGNRequest, pgn)
+	assert.Equal(t, Address(0x17), da)
+	assert.Equal(t, Address(0xF9), sa)
+	assert.Equal(t, uint32(0x18EA17F9), MakeID(6, PGNRequest, 0x17, 0xF9))
+
+	m, err := FromFrame(&socketcan.CANFrame{ID: 0x18FEF100, Extended: true, DLC: 2, Data: []byte{1, 2, 0, 0, 0, 0, 0, 0}})
+	assert.Nil(t, err)
+	assert.Equal(t, PGN(0xFEF1), m.PGN)
+	assert.Equal(t, []byte{1, 2}, m.Data)
+	_, err = FromFrame(&socketcan.CANFrame{ID: 0x123})
+	assert.NotNil(t, err)
+}
+
+func TestAddressClaim(t *testing.T) {
+	bus := &memBus{}
+	a := newTestConn(t, bus, Config{Name: 0x100, Address: 0x80})
+	assert.Equal(t, Address(0x80), a.Address())
+
+	// b loses against a and is arbitrary address capable
+	b := newTestConn(t, bus, Config{Name: 1<<63 | 0x200, Address: 0x80})
+	assert.Equal(t, Address(0x81), b.Address())
+	assert.Equal(t, Address(0x80), a.Address())
+
+	// c loses against a and must use its preferred address
+	_, err := NewConn(bus.newDevice(t), Config{Name: 0x300, Address: 0x80})
+	assert.Equal(t, ErrAddressClaimFailed, err)
+
+	// a request for the address claim is answered by all nodes
+	req := &Message{PGN: PGNRequest, Priority: DefaultPriority, Destination: AddressGlobal, Data: []byte{0x00, 0xEE, 0x00}}
+	assert.Nil(t, b.Send(req))
+	m := receivePGN(t, b, PGNAddressClaimed)
+	assert.Equal(t, Address(0x80), m.Source)
+
+	// d wins against a, a loses its address
+	d := newTestConn(t, bus, Config{Name: 0x50, Address: 0x80})
+	assert.Equal(t, Address(0x80), d.Address())
+	assert.Equal(t, AddressNull, a.Address())
+	assert.Equal(t, ErrNoAddress, a.Send(&Message{PGN: 0xFEF1, Data: []byte{1}}))
+}
+
+// closeCheckTransport records whether the transport is closed while setAddress is in progress.
+// The second setAddress (the first reclaim) signals reclaiming, takes some time and then signals reclaimed.
+type closeCheckTransport struct {
+	transport
+	reclaiming chan struct{}
+	reclaimed  chan struct{}
+
+	mu        sync.Mutex
+	calls     int
+	closed    bool
+	usedAfter bool
+}
+
+func (t *closeCheckTransport) setAddress(a Address) error {
+	t.mu.Lock()
+	t.calls++
+	reclaim := t.calls == 2
+	t.mu.Unlock()
+	if reclaim {
+		close(t.reclaiming)
+		time.Sleep(100 * time.Millisecond)
+	}
+	err := t.transport.setAddress(a)
+	t.mu.Lock()
+	t.usedAfter = t.usedAfter || t.closed
+	t.mu.Unlock()
+	if reclaim {
+		close(t.reclaimed)
+	}
+	return err
+}
+
+func (t *closeCheckTransport) close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	return t.transport.close()
+}
+
+func TestCloseDuringReclaim(t *testing.T) {
+	bus := &memBus{}
+	ct := &closeCheckTransport{
+		transport:  newUserspaceTransport(bus.newDevice(t), DefaultMaxMessageLen),
+		reclaiming: make(chan struct{}),
+		reclaimed:  make(chan struct{}),
+	}
+	a, err := newConn(ct, Config{Name: 1<<63 | 0x100, Address: 0x80})
+	assert.Nil(t, err)
+
+	// a claim of a higher priority NAME, a claims another address
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, 0x50)
+	f, err := (&Message{PGN: PGNAddressClaimed, Priority: DefaultPriority, Source: 0x80, Destination: AddressGlobal, Data: data}).Frame()
+	assert.Nil(t, err)
+	assert.Nil(t, bus.newDevice(t).Send(f))
+	<-ct.reclaiming
+	assert.Nil(t, a.Close())
+	<-ct.reclaimed
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	assert.False(t, ct.usedAfter)
+}
+
+func TestSingleFrame(t *testing.T) {
+	bus := &memBus{}
+	a := newTestConn(t, bus, Config{Address: 0x10})
+	b := newTestConn(t, bus, Config{Address: 0x20})
+	c := newTestConn(t, bus, Config{Address: 0x30})
+
+	assert.Nil(t, a.Send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Destination: 0x30, Data: []byte{1, 2, 3}}))
+	assert.Nil(t, a.Send(&Message{PGN: 0xFEF1, Priority: 3, Destination: 0x30, Data: []byte{4}}))
+
+	// b only receives the broadcast
+	m, err := b.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, PGN(0xFEF1), m.PGN)
+	assert.Equal(t, AddressGlobal, m.Destination)
+	assert.Equal(t, uint8(3), m.Priority)
+
+	m, err = c.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, PGN(0xEF00), m.PGN)
+	assert.Equal(t, Address(0x10), m.Source)
+	assert.Equal(t, Address(0x30), m.Destination)
+	assert.Equal(t, []byte{1, 2, 3}, m.Data)
+}
+
+func TestTransportProtocol(t *testing.T) {
+	bus := &memBus{}
+	a := newTestConn(t, bus, Config{Address: 0x10})
+	b := newTestConn(t, bus, Config{Address: 0x20})
+
+	for _, size := range []int{9, 100, MaxTPLen, MaxTPLen + 1, 3000} {
+		data := testData(size)
+		assert.Nil(t, a.Send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Destination: 0x20, Data: data}))
+		m, err := b.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, PGN(0xEF00), m.PGN)
+		assert.Equal(t, Address(0x10), m.Source)
+		assert.Equal(t, data, m.Data, "size %d", size)
+	}
+
+	// no receiver
+	err := a.Send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Destination: 0x40, Data: testData(20)})
+	assert.Equal(t, ErrTimeout, err)
+}
+
+func TestMaxMessageLen(t *testing.T) {
+	bus := &memBus{}
+	a := newTestConn(t, bus, Config{Address: 0x10})
+	newTestConn(t, bus, Config{Address: 0x20, MaxMessageLen: 1000})
+
+	for _, size := range []int{1001, 3000} {
+		err := a.Send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Destination: 0x20, Data: testData(size)})
+		assert.True(t, errors.Is(err, ErrAborted), "size %d: %v", size, err)
+	}
+	assert.Nil(t, a.Send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Destination: 0x20, Data: testData(1000)}))
+}
+
+func TestBroadcast(t *testing.T) {
+	bus := &memBus{}
+	a := newTestConn(t, bus, Config{Address: 0x10})
+	b := newTestConn(t, bus, Config{Address: 0x20})
+	c := newTestConn(t, bus, Config{Address: 0x30})
+
+	data := testData(20)
+	assert.Nil(t, a.Send(&Message{PGN: 0xFECA, Priority: DefaultPriority, Data: data}))
+	for _, r := range []*Conn{b, c} {
+		m, err := r.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, PGN(0xFECA), m.PGN)
+		assert.Equal(t, AddressGlobal, m.Destination)
+		assert.Equal(t, data, m.Data)
+	}
+
+	assert.NotNil(t, a.Send(&Message{PGN: 0xFECA, Data: testData(MaxTPLen + 1)}))
+}
+
+func TestDialVcan(t *testing.T) {
+	a, err := Dial("vcan0", Config{Name: 0x1234, Address: 0x80})
+	if err != nil {
+		t.Skipf("vcan0 not available: %v", err)
+	}
+	defer a.Close()
+	b, err := DialUserspace("vcan0", Config{Address: 0x20})
+	assert.Nil(t, err)
+	defer b.Close()
+	b.SetReceiveTimeout(3 * time.Second)
+
+	data := testData(100)
+	assert.Nil(t, a.Send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Destination: 0x20, Data: data}))
+	m := receivePGN(t, b, 0xEF00)
+	if m != nil {
+		assert.Equal(t, data, m.Data)
+	}
+}
+
+func TestKernelReceiveVcan(t *testing.T) {
+	a, err := newKernelTransport("vcan0", Config{})
+	if err != nil {
+		t.Skipf("vcan0 with can-j1939 not available: %v", err)
+	}
+	defer a.close()
+	b, err := newKernelTransport("vcan0", Config{MaxMessageLen: 100})
+	assert.Nil(t, err)
+	defer b.close()
+	assert.Nil(t, a.setAddress(0x10))
+	assert.Nil(t, b.setAddress(0x20))
+
+	receive := func() (*Message, error) {
+		for {
+			m, err := b.receive(nil)
+			if err != socketcan.ErrReceiveTimeout {
+				return m, err
+			}
+		}
+	}
+	for _, size := range []int{3, 100} {
+		data := testData(size)
+		assert.Nil(t, a.send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Source: 0x10, Destination: 0x20, Data: data}))
+		m, err := receive()
+		if assert.Nil(t, err) {
+			assert.Equal(t, data, m.Data)
+			assert.Equal(t, Address(0x10), m.Source)
+			assert.Equal(t, Address(0x20), m.Destination)
+		}
+	}
+
+	// longer than MaxMessageLen of b
+	assert.Nil(t, a.send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Source: 0x10, Destination: 0x20, Data: testData(101)}))
+	_, err = receive()
+	assert.Equal(t, ErrMessageTooLong, err)
+
+	// b continues to receive
+	assert.Nil(t, a.send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Source: 0x10, Destination: 0x20, Data: []byte{1}}))
+	m, err := receive()
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte{1}, m.Data)
+	}
+}
+
+func TestFloodWithoutReceive(t *testing.T) {
+	bus := &memBus{}
+	a := newTestConn(t, bus, Config{Name: 0x100, Address: 0x80})
+	b := newTestConn(t, bus, Config{Address: 0x20})
+	raw := bus.newDevice(t)
+	// b receives all messages, the transfer from a is passed to bMsgs
+	bMsgs := make(chan *Message, 1)
+	go func() {
+		for {
+			m, err := b.Receive()
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+			if err == nil && m.PGN == 0xEF00 {
+				bMsgs <- m
+			}
+		}
+	}()
+
+	// a doesn't call Receive
+	for i := 0; i < 300; i++ {
+		f, err := (&Message{PGN: 0xFEF1, Priority: DefaultPriority, Source: 0x30, Destination: AddressGlobal, Data: []byte{byte(i)}}).Frame()
+		assert.Nil(t, err)
+		assert.Nil(t, raw.Send(f))
+	}
+
+	// a still answers a request for the address claim
+	req, err := (&Message{PGN: PGNRequest, Priority: DefaultPriority, Source: 0x30, Destination: AddressGlobal,
+		Data: appendPGN(nil, PGNAddressClaimed)}).Frame()
+	assert.Nil(t, err)
+	assert.Nil(t, raw.Send(req))
+	deadline := time.After(3 * time.Second)
+	for claimed := false; !claimed; {
+		select {
+		case f := <-raw.rx:
+			m, err := FromFrame(f)
+			claimed = err == nil && m.PGN == PGNAddressClaimed && m.Source == 0x80
+		case <-deadline:
+			t.Fatal("no address claim")
+		}
+	}
+
+	// and handles the transport protocol of its transfers
+	data := testData(100)
+	assert.Nil(t, a.Send(&Message{PGN: 0xEF00, Priority: DefaultPriority, Destination: 0x20, Data: data}))
+	select {
+	case m := <-bMsgs:
+		assert.Equal(t, data, m.Data)
+	case <-time.After(3 * time.Second):
+		t.Fatal("transfer not received")
+	}
+
+	_, err = a.Receive()
+	assert.Equal(t, ErrOverflow, err)
+	m, err := a.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, PGN(0xFEF1), m.PGN)
+}
@@ -0,0 +1,140 @@
+package j1939
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+	"golang.org/x/sys/unix"
+)
+
+// errNoKernelSupport is returned by newKernelTransport if the kernel has no CAN_J1939 support.
+// Dial falls back to the userspace implementation only on this error.
+var errNoKernelSupport = errors.New("no kernel support for CAN_J1939")
+
+// socket options and control messages, see linux/can/j1939.h
+const (
+	solCANJ1939       = unix.SOL_CAN_BASE + unix.CAN_J1939
+	soJ1939SendPrio   = 3
+	scmJ1939DestAddr  = 1
+	scmJ1939Prio      = 3
+	j1939NoPGN        = 0x40000
+	kernelOOBSize     = 64
+	kernelRecvTimeout = 200 // ms, lets receive check for close
+)
+
+// kernelTransport uses a kernel CAN_J1939 socket. The kernel implements TP and ETP.
+type kernelTransport struct {
+	socket  int
+	ifindex int
+	name    Name
+
+	mu sync.Mutex // serializes the send priority option and sendto
+
+	// receive buffers, only used by receive
+	buf []byte
+	oob []byte
+}
+
+func newKernelTransport(interfaceName string, cfg Config) (*kernelTransport, error) {
+	socket, err := unix.Socket(unix.AF_CAN, unix.SOCK_DGRAM, unix.CAN_J1939)
+	if err == unix.EPROTONOSUPPORT || err == unix.EAFNOSUPPORT {
+		return nil, fmt.Errorf("%w: %v", errNoKernelSupport, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't create CAN_J1939 socket: %w", err)
+	}
+	ifc, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		unix.Close(socket)
+		return nil, err
+	}
+	// address claims and broadcasts are sent to the global address
+	if err = unix.SetsockoptInt(socket, unix.SOL_SOCKET, unix.SO_BROADCAST, 1); err != nil {
+		unix.Close(socket)
+		return nil, err
+	}
+	tv := unix.NsecToTimeval(kernelRecvTimeout * 1000000)
+	if err = unix.SetsockoptTimeval(socket, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(socket)
+		return nil, err
+	}
+	return &kernelTransport{
+		socket:  socket,
+		ifindex: ifc.Index,
+		name:    cfg.Name,
+		buf:     make([]byte, cfg.maxMessageLen()),
+		oob:     make([]byte, unix.CmsgSpace(kernelOOBSize)),
+	}, nil
+}
+
+// setAddress binds the socket to the NAME and the address. The kernel allows to re-bind to change the address.
+func (t *kernelTransport) setAddress(a Address) error {
+	addr := &unix.SockaddrCANJ1939{Ifindex: t.ifindex, Name: uint64(t.name), PGN: j1939NoPGN, Addr: uint8(a)}
+	if err := unix.Bind(t.socket, addr); err != nil {
+		return fmt.Errorf("can't bind j1939 socket to address 0x%02X: %v", a, err)
+	}
+	return nil
+}
+
+func (t *kernelTransport) send(m *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := unix.SetsockoptInt(t.socket, solCANJ1939, soJ1939SendPrio, int(m.Priority)); err != nil {
+		return err
+	}
+	addr := &unix.SockaddrCANJ1939{Ifindex: t.ifindex, PGN: uint32(m.PGN), Addr: uint8(m.Destination)}
+	return unix.Sendto(t.socket, m.Data, 0, addr)
+}
+
+func (t *kernelTransport) receive(done <-chan struct{}) (*Message, error) {
+	select {
+	case <-done:
+		return nil, ErrClosed
+	default:
+	}
+	// CAN_J1939 sockets accept no flags like MSG_PEEK, a longer message is truncated to buf
+	n, oobn, flags, from, err := unix.Recvmsg(t.socket, t.buf, t.oob, 0)
+	if err == unix.EAGAIN {
+		return nil, socketcan.ErrReceiveTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	if flags&unix.MSG_TRUNC != 0 {
+		return nil, ErrMessageTooLong
+	}
+	src, ok := from.(*unix.SockaddrCANJ1939)
+	if !ok {
+		return nil, fmt.Errorf("unexpected j1939 source address %v", from)
+	}
+	m := &Message{
+		PGN:         PGN(src.PGN),
+		Priority:    DefaultPriority,
+		Source:      Address(src.Addr),
+		Destination: AddressGlobal,
+		Data:        append([]byte(nil), t.buf[:n]...),
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(t.oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level != solCANJ1939 || len(cmsg.Data) < 1 {
+			continue
+		}
+		switch cmsg.Header.Type {
+		case scmJ1939DestAddr:
+			m.Destination = Address(cmsg.Data[0])
+		case scmJ1939Prio:
+			m.Priority = cmsg.Data[0]
+		}
+	}
+	return m, nil
+}
+
+func (t *kernelTransport) close() error {
+	return unix.Close(t.socket)
+}
@@ -0,0 +1,564 @@
+package j1939
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ci4rail/socketcan-io4edge/pkg/socketcan"
+)
+
+// control bytes of TP.CM and ETP.CM
+const (
+	tpRTS   = 16
+	tpCTS   = 17
+	tpEOMA  = 19
+	tpBAM   = 32
+	etpRTS  = 20
+	etpCTS  = 21
+	etpDPO  = 22
+	etpEOMA = 23
+	tpAbort = 255
+)
+
+// abort reasons
+const (
+	abortResources   = 2
+	abortTimeout     = 3
+	abortBadSequence = 7
+)
+
+const (
+	// tpPriority is the priority of TP and ETP frames
+	tpPriority = 7
+	// bamPacketInterval is the time between the data packets of a broadcast (50..200ms)
+	bamPacketInterval = 50 * time.Millisecond
+	// timeouts of the receiver: T1 after a BAM data packet, T2 after a CTS
+	timeoutT1 = 750 * time.Millisecond
+	timeoutT2 = 1250 * time.Millisecond
+	// timeout of the sender waiting for CTS or EOMA
+	timeoutT3 = 1250 * time.Millisecond
+	// maximum number of packets requested with one CTS
+	maxPacketsPerCTS = 255
+)
+
+// FrameDevice sends and receives CAN frames, e.g. a socketcan.RawInterface
+type FrameDevice interface {
+	Send(f *socketcan.CANFrame) error
+	// Receive may return socketcan.ErrReceiveTimeout, the node then continues to receive
+	Receive() (*socketcan.CANFrame, error)
+}
+
+type sessionKey struct {
+	source      Address
+	destination Address
+	etp         bool
+}
+
+// rxSession is a multi-packet transfer received from another node
+type rxSession struct {
+	pgn        PGN
+	priority   uint8
+	size       int
+	packets    int
+	data       []byte
+	received   int // number of the last received packet
+	windowEnd  int // number of the last packet requested by the last CTS
+	maxPerCTS  int
+	dpoOffset  int // ETP: packet offset of the data packets
+	broadcast  bool
+	lastPacket time.Time
+}
+
+// userspaceTransport implements TP and ETP on top of a FrameDevice
+type userspaceTransport struct {
+	dev    FrameDevice
+	ownDev *socketcan.RawInterface // closed by close, if not nil
+	maxLen int                     // maximum length of received messages
+
+	txMu       sync.Mutex // one multi-packet transfer at a time
+	devMu      sync.Mutex // serializes frames of send and of the receiver
+	frames     chan *socketcan.CANFrame
+	msgs       chan rxResult
+	cm         chan *Message // TP.CM and ETP.CM for the transfer of send
+	done       chan struct{}
+	readerDone chan struct{}
+	closeOnce  sync.Once
+
+	mu   sync.Mutex
+	addr Address
+
+	sessions map[sessionKey]*rxSession // only accessed by run
+}
+
+func newUserspaceTransport(dev FrameDevice, maxLen int) *userspaceTransport {
+	t := &userspaceTransport{
+		dev:        dev,
+		maxLen:     maxLen,
+		frames:     make(chan *socketcan.CANFrame, 64),
+		msgs:       make(chan rxResult, 64),
+		cm:         make(chan *Message, 4),
+		done:       make(chan struct{}),
+		readerDone: make(chan struct{}),
+		addr:       AddressNull,
+		sessions:   make(map[sessionKey]*rxSession),
+	}
+	go t.readFrames()
+	go t.run()
+	return t
+}
+
+func (t *userspaceTransport) setAddress(a Address) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addr = a
+	return nil
+}
+
+func (t *userspaceTransport) address() Address {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.addr
+}
+
+func (t *userspaceTransport) receive(done <-chan struct{}) (*Message, error) {
+	select {
+	case r := <-t.msgs:
+		return r.msg, r.err
+	case <-done:
+		return nil, ErrClosed
+	case <-t.done:
+		return nil, ErrClosed
+	}
+}
+
+func (t *userspaceTransport) close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.done)
+		if t.ownDev != nil {
+			// unblocks the reader
+			err = t.ownDev.Close()
+			<-t.readerDone
+		}
+	})
+	return err
+}
+
+func (t *userspaceTransport) send(m *Message) error {
+	switch {
+	case len(m.Data) <= socketcan.CANMaxDLen:
+		return t.sendFrame(m.Priority, m.PGN, m.Destination, m.Source, m.Data)
+	case len(m.Data) > MaxMessageLen:
+		return fmt.Errorf("message too long (%d bytes)", len(m.Data))
+	case m.Destination == AddressGlobal && len(m.Data) > MaxTPLen:
+		return fmt.Errorf("broadcasts are limited to %d bytes", MaxTPLen)
+	}
+
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	// discard connection management messages of previous transfers
+	for len(t.cm) > 0 {
+		<-t.cm
+	}
+	switch {
+	case m.Destination == AddressGlobal:
+		return t.sendBAM(m)
+	case len(m.Data) <= MaxTPLen:
+		return t.sendTP(m)
+	}
+	return t.sendETP(m)
+}
+
+// sendBAM broadcasts m with the broadcast announce message
+func (t *userspaceTransport) sendBAM(m *Message) error {
+	packets := numPackets(len(m.Data))
+	cm := []byte{tpBAM, byte(len(m.Data)), byte(len(m.Data) >> 8), byte(packets), 0xFF}
+	if err := t.sendFrame(tpPriority, PGNTPCM, AddressGlobal, m.Source, appendPGN(cm, m.PGN)); err != nil {
+		return err
+	}
+	for p := 1; p <= packets; p++ {
+		time.Sleep(bamPacketInterval)
+		if err := t.sendFrame(tpPriority, PGNTPDT, AddressGlobal, m.Source, packet(m.Data, p, p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendTP sends m to its destination with RTS/CTS
+func (t *userspaceTransport) sendTP(m *Message) error {
+	packets := numPackets(len(m.Data))
+	cm := []byte{tpRTS, byte(len(m.Data)), byte(len(m.Data) >> 8), byte(packets), 0xFF}
+	if err := t.sendFrame(tpPriority, PGNTPCM, m.Destination, m.Source, appendPGN(cm, m.PGN)); err != nil {
+		return err
+	}
+	for {
+		r, err := t.waitCM(m, PGNTPCM)
+		if err != nil {
+			return err
+		}
+		switch r.Data[0] {
+		case tpCTS:
+			n, next := int(r.Data[1]), int(r.Data[2])
+			for p := next; p < next+n && p <= packets; p++ {
+				if err := t.sendFrame(tpPriority, PGNTPDT, m.Destination, m.Source, packet(m.Data, p, p)); err != nil {
+					return err
+				}
+			}
+		case tpEOMA:
+			return nil
+		}
+	}
+}
+
+// sendETP sends m to its destination with the extended transport protocol
+func (t *userspaceTransport) sendETP(m *Message) error {
+	packets := numPackets(len(m.Data))
+	cm := []byte{etpRTS, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(cm[1:5], uint32(len(m.Data)))
+	if err := t.sendFrame(tpPriority, PGNETPCM, m.Destination, m.Source, appendPGN(cm, m.PGN)); err != nil {
+		return err
+	}
+	for {
+		r, err := t.waitCM(m, PGNETPCM)
+		if err != nil {
+			return err
+		}
+		switch r.Data[0] {
+		case etpCTS:
+			n, next := int(r.Data[1]), int(getUint24(r.Data[2:5]))
+			if n == 0 {
+				continue
+			}
+			offset := next - 1
+			dpo := appendUint24([]byte{etpDPO, byte(n)}, uint32(offset))
+			if err := t.sendFrame(tpPriority, PGNETPCM, m.Destination, m.Source, appendPGN(dpo, m.PGN)); err != nil {
+				return err
+			}
+			for seq := 1; seq <= n && offset+seq <= packets; seq++ {
+				if err := t.sendFrame(tpPriority, PGNETPDT, m.Destination, m.Source, packet(m.Data, offset+seq, seq)); err != nil {
+					return err
+				}
+			}
+		case etpEOMA:
+			return nil
+		}
+	}
+}
+
+// waitCM waits for CTS, EOMA or abort of the receiver of m (T3)
+func (t *userspaceTransport) waitCM(m *Message, cmPGN PGN) (*Message, error) {
+	timer := time.NewTimer(timeoutT3)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-t.cm:
+			if r.Source != m.Destination || r.PGN != cmPGN || getUint24(r.Data[5:8]) != uint32(m.PGN) {
+				continue
+			}
+			if r.Data[0] == tpAbort {
+				return nil, fmt.Errorf("%w: reason %d", ErrAborted, r.Data[1])
+			}
+			return r, nil
+		case <-timer.C:
+			t.sendAbort(cmPGN, m.PGN, m.Source, m.Destination, abortTimeout)
+			return nil, ErrTimeout
+		case <-t.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// readFrames passes the frames from dev to run
+func (t *userspaceTransport) readFrames() {
+	defer close(t.readerDone)
+	for {
+		f, err := t.dev.Receive()
+		if errors.Is(err, socketcan.ErrReceiveTimeout) {
+			select {
+			case <-t.done:
+				return
+			default:
+				continue
+			}
+		}
+		if err != nil {
+			t.deliver(rxResult{err: err})
+			return
+		}
+		select {
+		case t.frames <- f:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// run handles the received frames and the timeouts of the receive sessions
+func (t *userspaceTransport) run() {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case f := <-t.frames:
+			t.handleFrame(f)
+		case now := <-ticker.C:
+			t.expireSessions(now)
+		}
+	}
+}
+
+func (t *userspaceTransport) handleFrame(f *socketcan.CANFrame) {
+	m, err := FromFrame(f)
+	if err != nil || f.FD {
+		return
+	}
+	own := t.address()
+	switch m.PGN {
+	case PGNTPCM, PGNETPCM:
+		if len(m.Data) < 8 {
+			return
+		}
+		if m.Destination == own || (m.Destination == AddressGlobal && m.Data[0] == tpBAM) {
+			t.handleCM(m)
+		}
+	case PGNTPDT, PGNETPDT:
+		if len(m.Data) < 8 {
+			return
+		}
+		if m.Destination == own || m.Destination == AddressGlobal {
+			t.handleDT(m)
+		}
+	default:
+		t.deliver(rxResult{msg: m})
+	}
+}
+
+func (t *userspaceTransport) handleCM(m *Message) {
+	pgn := PGN(getUint24(m.Data[5:8]))
+	etp := m.PGN == PGNETPCM
+	key := sessionKey{source: m.Source, destination: m.Destination, etp: etp}
+	now := time.Now()
+
+	switch m.Data[0] {
+	case tpBAM, tpRTS:
+		if etp {
+			return
+		}
+		size := int(binary.LittleEndian.Uint16(m.Data[1:3]))
+		s := &rxSession{
+			pgn:        pgn,
+			priority:   m.Priority,
+			size:       size,
+			packets:    int(m.Data[3]),
+			maxPerCTS:  int(m.Data[4]),
+			broadcast:  m.Data[0] == tpBAM,
+			lastPacket: now,
+		}
+		if size <= socketcan.CANMaxDLen || s.packets != numPackets(size) {
+			return
+		}
+		if size > t.maxLen {
+			if !s.broadcast {
+				t.sendAbort(PGNTPCM, pgn, m.Destination, m.Source, abortResources)
+			}
+			return
+		}
+		s.data = make([]byte, s.packets*7)
+		t.sessions[key] = s
+		if !s.broadcast {
+			t.sendCTS(key, s)
+		}
+	case etpRTS:
+		if !etp {
+			return
+		}
+		size := int(binary.LittleEndian.Uint32(m.Data[1:5]))
+		if size <= MaxTPLen {
+			return
+		}
+		// the size is limited, as any node can request the allocation of the receive buffer
+		if size > t.maxLen {
+			t.sendAbort(PGNETPCM, pgn, m.Destination, m.Source, abortResources)
+			return
+		}
+		s := &rxSession{
+			pgn:        pgn,
+			priority:   m.Priority,
+			size:       size,
+			packets:    numPackets(size),
+			maxPerCTS:  maxPacketsPerCTS,
+			lastPacket: now,
+		}
+		s.data = make([]byte, s.packets*7)
+		t.sessions[key] = s
+		t.sendCTS(key, s)
+	case etpDPO:
+		if s, ok := t.sessions[key]; ok && etp {
+			s.dpoOffset = int(getUint24(m.Data[2:5]))
+			s.lastPacket = now
+		}
+	case tpAbort:
+		delete(t.sessions, key)
+		t.forwardCM(m)
+	default:
+		// CTS and EOMA for the transfer of send
+		t.forwardCM(m)
+	}
+}
+
+func (t *userspaceTransport) handleDT(m *Message) {
+	key := sessionKey{source: m.Source, destination: m.Destination, etp: m.PGN == PGNETPDT}
+	s, ok := t.sessions[key]
+	if !ok {
+		return
+	}
+	p := s.dpoOffset + int(m.Data[0])
+	if p != s.received+1 {
+		delete(t.sessions, key)
+		if !s.broadcast {
+			t.sendAbort(cmPGN(key.etp), s.pgn, m.Destination, m.Source, abortBadSequence)
+		}
+		return
+	}
+	copy(s.data[(p-1)*7:], m.Data[1:8])
+	s.received = p
+	s.lastPacket = time.Now()
+
+	if p == s.packets {
+		delete(t.sessions, key)
+		if !s.broadcast {
+			t.sendEOMA(key, s)
+		}
+		t.deliver(rxResult{msg: &Message{
+			PGN:         s.pgn,
+			Priority:    s.priority,
+			Source:      key.source,
+			Destination: key.destination,
+			Data:        s.data[:s.size],
+		}})
+		return
+	}
+	if !s.broadcast && p == s.windowEnd {
+		t.sendCTS(key, s)
+	}
+}
+
+// expireSessions removes the receive sessions without data packets for T1 (broadcast) or T2
+func (t *userspaceTransport) expireSessions(now time.Time) {
+	for key, s := range t.sessions {
+		timeout := timeoutT2
+		if s.broadcast {
+			timeout = timeoutT1
+		}
+		if now.Sub(s.lastPacket) < timeout {
+			continue
+		}
+		delete(t.sessions, key)
+		if !s.broadcast {
+			t.sendAbort(cmPGN(key.etp), s.pgn, key.destination, key.source, abortTimeout)
+		}
+	}
+}
+
+// sendCTS requests the next packets of s
+func (t *userspaceTransport) sendCTS(key sessionKey, s *rxSession) {
+	n := s.packets - s.received
+	if s.maxPerCTS != 0 && n > s.maxPerCTS {
+		n = s.maxPerCTS
+	}
+	if n > maxPacketsPerCTS {
+		n = maxPacketsPerCTS
+	}
+	s.windowEnd = s.received + n
+	var cm []byte
+	if key.etp {
+		cm = appendUint24([]byte{etpCTS, byte(n)}, uint32(s.received+1))
+	} else {
+		cm = []byte{tpCTS, byte(n), byte(s.received + 1), 0xFF, 0xFF}
+	}
+	t.sendFrame(tpPriority, cmPGN(key.etp), key.source, key.destination, appendPGN(cm, s.pgn))
+}
+
+func (t *userspaceTransport) sendEOMA(key sessionKey, s *rxSession) {
+	var cm []byte
+	if key.etp {
+		cm = []byte{etpEOMA, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(cm[1:5], uint32(s.size))
+	} else {
+		cm = []byte{tpEOMA, byte(s.size), byte(s.size >> 8), byte(s.packets), 0xFF}
+	}
+	t.sendFrame(tpPriority, cmPGN(key.etp), key.source, key.destination, appendPGN(cm, s.pgn))
+}
+
+func (t *userspaceTransport) sendAbort(cmPGN PGN, pgn PGN, source Address, destination Address, reason uint8) {
+	cm := []byte{tpAbort, reason, 0xFF, 0xFF, 0xFF}
+	t.sendFrame(tpPriority, cmPGN, destination, source, appendPGN(cm, pgn))
+}
+
+// forwardCM passes connection management messages to send. They are dropped if no transfer is active.
+func (t *userspaceTransport) forwardCM(m *Message) {
+	select {
+	case t.cm <- m:
+	default:
+	}
+}
+
+func (t *userspaceTransport) sendFrame(priority uint8, pgn PGN, destination Address, source Address, data []byte) error {
+	m := &Message{PGN: pgn, Priority: priority, Source: source, Destination: destination, Data: data}
+	f, err := m.Frame()
+	if err != nil {
+		return err
+	}
+	t.devMu.Lock()
+	defer t.devMu.Unlock()
+	return t.dev.Send(f)
+}
+
+func (t *userspaceTransport) deliver(r rxResult) {
+	select {
+	case t.msgs <- r:
+	case <-t.done:
+	}
+}
+
+func cmPGN(etp bool) PGN {
+	if etp {
+		return PGNETPCM
+	}
+	return PGNTPCM
+}
+
+// numPackets returns the number of data packets for size bytes
+func numPackets(size int) int {
+	return (size + 6) / 7
+}
+
+// packet returns the data packet with number p of data, sequence number seq and padded with 0xFF
+func packet(data []byte, p int, seq int) []byte {
+	pkt := []byte{byte(seq), 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	start := (p - 1) * 7
+	end := start + 7
+	if end > len(data) {
+		end = len(data)
+	}
+	copy(pkt[1:], data[start:end])
+	return pkt
+}
+
+func appendPGN(b []byte, pgn PGN) []byte {
+	return appendUint24(b, uint32(pgn))
+}
+
+func appendUint24(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
+
+func getUint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
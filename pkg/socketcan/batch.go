@@ -0,0 +1,173 @@
+package socketcan
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxBatchSize is the number of preallocated frame buffers of ReceiveBatch and SendBatch. Larger batches are split.
+const maxBatchSize = 64
+
+// mmsghdr is struct mmsghdr of recvmmsg and sendmmsg
+type mmsghdr struct {
+	Hdr unix.Msghdr
+	Len uint32
+}
+
+// batchBuffers are the frame buffers of recvmmsg or sendmmsg, allocated on first use
+type batchBuffers struct {
+	mu   sync.Mutex
+	data []byte // maxBatchSize * canFDMTU
+	iovs []unix.Iovec
+	hdrs []mmsghdr
+}
+
+func (b *batchBuffers) init() {
+	if b.data != nil {
+		return
+	}
+	b.data = make([]byte, maxBatchSize*canFDMTU)
+	b.iovs = make([]unix.Iovec, maxBatchSize)
+	b.hdrs = make([]mmsghdr, maxBatchSize)
+	for n := range b.hdrs {
+		b.iovs[n].Base = &b.data[n*canFDMTU]
+		b.iovs[n].SetLen(canFDMTU)
+		b.hdrs[n].Hdr.Iov = &b.iovs[n]
+		b.hdrs[n].Hdr.SetIovlen(1)
+	}
+}
+
+// frame returns the buffer of the frame with index n
+func (b *batchBuffers) frame(n int) []byte {
+	return b.data[n*canFDMTU : (n+1)*canFDMTU]
+}
+
+// ReceiveBatch receives up to max CAN frames with one recvmmsg syscall.
+// Blocks until at least one frame is available. Error frames are ignored.
+// The receive timeout and the read deadline apply as for Receive.
+func (i *RawInterface) ReceiveBatch(max int) ([]*CANFrame, error) {
+	if err := i.applyReceiveTimeout(); err != nil {
+		return nil, err
+	}
+	return i.receiveBatch(max)
+}
+
+// ReceiveBatchContext receives up to max CAN frames like ReceiveBatch.
+// It returns ctx.Err() when ctx is cancelled or its deadline expires, see ReceiveContext.
+func (i *RawInterface) ReceiveBatchContext(ctx context.Context, max int) ([]*CANFrame, error) {
+	var frames []*CANFrame
+	err := i.withContext(ctx, func() error {
+		var err error
+		frames, err = i.receiveBatch(max)
+		return err
+	})
+	return frames, err
+}
+
+func (i *RawInterface) receiveBatch(max int) ([]*CANFrame, error) {
+	if max < 1 {
+		max = 1
+	}
+	if max > maxBatchSize {
+		max = maxBatchSize
+	}
+	b := &i.rxBatch
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+
+	for {
+		var n int
+		var opErr error
+		err := i.conn.Read(func(fd uintptr) bool {
+			n, opErr = mmsg(unix.SYS_RECVMMSG, int(fd), b.hdrs[:max])
+			return opErr != unix.EAGAIN
+		})
+		if err != nil {
+			return nil, i.ioError(err, ErrReceiveTimeout)
+		}
+		if opErr != nil {
+			return nil, opErr
+		}
+
+		frames := make([]*CANFrame, 0, n)
+		for k := 0; k < n; k++ {
+			size := int(b.hdrs[k].Len)
+			if size != canMTU && size != canFDMTU {
+				return nil, fmt.Errorf("unexpected CAN frame size %d", size)
+			}
+			frameBytes := b.frame(k)[:size]
+			if binary.LittleEndian.Uint32(frameBytes[0:4])&canErrFlag != 0 {
+				continue
+			}
+			frames = append(frames, unmarshalFrame(frameBytes))
+		}
+		if len(frames) > 0 {
+			return frames, nil
+		}
+	}
+}
+
+// SendBatch sends the frames with as few sendmmsg syscalls as possible.
+// Returns the number of frames sent. If err is not nil, frames[sent] is the frame that failed.
+// The write deadline applies as for Send.
+func (i *RawInterface) SendBatch(frames []*CANFrame) (sent int, err error) {
+	b := &i.txBatch
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+
+	for sent < len(frames) {
+		chunk := frames[sent:]
+		if len(chunk) > maxBatchSize {
+			chunk = chunk[:maxBatchSize]
+		}
+		// marshal the frames up to the first invalid one
+		var marshalErr error
+		for k, f := range chunk {
+			var size int
+			if f.FD && !i.fdMode {
+				marshalErr = fmt.Errorf("can't send CAN FD frame, interface %s not in FD mode", i.ifName)
+			} else {
+				size, marshalErr = marshalFrameInto(b.frame(k), f)
+			}
+			if marshalErr != nil {
+				chunk = chunk[:k]
+				break
+			}
+			b.iovs[k].SetLen(size)
+		}
+		if len(chunk) == 0 {
+			return sent, marshalErr
+		}
+
+		var n int
+		var opErr error
+		err := i.conn.Write(func(fd uintptr) bool {
+			n, opErr = mmsg(unix.SYS_SENDMMSG, int(fd), b.hdrs[:len(chunk)])
+			return opErr != unix.EAGAIN
+		})
+		if err != nil {
+			return sent, i.ioError(err, ErrSendTimeout)
+		}
+		if opErr != nil {
+			return sent, opErr
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+// mmsg calls recvmmsg or sendmmsg without blocking
+func mmsg(trap uintptr, fd int, hdrs []mmsghdr) (int, error) {
+	r, _, errno := unix.Syscall6(trap, uintptr(fd), uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), unix.MSG_DONTWAIT, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
@@ -0,0 +1,312 @@
+package socketcan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BCMOpcode is the opcode of a broadcast manager message (see linux/can/bcm.h)
+type BCMOpcode uint32
+
+// BCMFlags are the flags of a broadcast manager message (see linux/can/bcm.h)
+type BCMFlags uint32
+
+const (
+	// BCMTxSetup creates or updates a cyclic transmission task
+	BCMTxSetup BCMOpcode = 1
+	// BCMTxDelete removes a cyclic transmission task
+	BCMTxDelete BCMOpcode = 2
+	// BCMTxRead reads the properties of a cyclic transmission task
+	BCMTxRead BCMOpcode = 3
+	// BCMTxSend sends one frame
+	BCMTxSend BCMOpcode = 4
+	// BCMRxSetup creates or updates a receive filter subscription
+	BCMRxSetup BCMOpcode = 5
+	// BCMRxDelete removes a receive filter subscription
+	BCMRxDelete BCMOpcode = 6
+	// BCMRxRead reads the properties of a receive filter subscription
+	BCMRxRead BCMOpcode = 7
+	// BCMTxStatus is the reply to BCMTxRead
+	BCMTxStatus BCMOpcode = 8
+	// BCMTxExpired notifies that the count of a transmission task has expired (with TX_COUNTEVT)
+	BCMTxExpired BCMOpcode = 9
+	// BCMRxStatus is the reply to BCMRxRead
+	BCMRxStatus BCMOpcode = 10
+	// BCMRxTimeout notifies that no frame has been received within the timeout of a subscription
+	BCMRxTimeout BCMOpcode = 11
+	// BCMRxChanged notifies that a received frame differs from the previous one in the filtered content
+	BCMRxChanged BCMOpcode = 12
+)
+
+const (
+	// BCMSetTimer sets ival1, ival2 and count of the message
+	BCMSetTimer BCMFlags = 0x0001
+	// BCMStartTimer starts the timer with the values of the message
+	BCMStartTimer BCMFlags = 0x0002
+	// BCMTxCountEvent sends a BCMTxExpired message when count expires
+	BCMTxCountEvent BCMFlags = 0x0004
+	// BCMTxAnnounce sends a changed frame immediately
+	BCMTxAnnounce BCMFlags = 0x0008
+	// BCMTxCopyCANID copies the ID of the message into the frames
+	BCMTxCopyCANID BCMFlags = 0x0010
+	// BCMRxFilterID filters by ID only, the message contains no frames
+	BCMRxFilterID BCMFlags = 0x0020
+	// BCMRxCheckDLC also reports a change of the DLC
+	BCMRxCheckDLC BCMFlags = 0x0040
+	// BCMRxNoAutoTimer does not start the timeout timer automatically
+	BCMRxNoAutoTimer BCMFlags = 0x0080
+	// BCMRxAnnounceResume reports the first frame after a timeout as changed
+	BCMRxAnnounceResume BCMFlags = 0x0100
+	// BCMTxResetMultiIdx restarts a multiplex transmission with the first frame
+	BCMTxResetMultiIdx BCMFlags = 0x0200
+	// BCMRxRTRFrame answers remote requests with the frame of the message
+	BCMRxRTRFrame BCMFlags = 0x0400
+	// BCMCANFDFrame marks that the message contains CAN FD frames
+	BCMCANFDFrame BCMFlags = 0x0800
+)
+
+const (
+	// longSize is the size of a C long, used in struct bcm_timeval
+	longSize = strconv.IntSize / 8
+	// bcmTimevalOffset is the offset of ival1 in struct bcm_msg_head, aligned like a long
+	bcmTimevalOffset = (12 + longSize - 1) &^ (longSize - 1)
+	// bcmHeadSize is sizeof(struct bcm_msg_head), the frames that follow are aligned to 8 bytes
+	bcmHeadSize = (bcmTimevalOffset + 4*longSize + 8 + 7) &^ 7
+)
+
+// BCMMessage is a message to or from the broadcast manager (struct bcm_msg_head followed by the frames)
+type BCMMessage struct {
+	Opcode BCMOpcode
+	Flags  BCMFlags
+	// number of frames sent with Interval1 before switching to Interval2
+	Count uint32
+	// TX: interval for the first Count frames. RX: timeout for BCMRxTimeout
+	Interval1 time.Duration
+	// TX: interval after Count frames. RX: minimum interval between BCMRxChanged messages (throttling)
+	Interval2 time.Duration
+	ID        uint32
+	Extended  bool
+	// TX: the frames to send. RX: the content mask (BCMRxSetup) or the received frame (BCMRxChanged)
+	Frames []*CANFrame
+}
+
+// BCMInterface is a broadcast manager (CAN_BCM) socket connected to a CAN interface.
+// The kernel sends cyclic frames and filters received frames for content changes and timeouts.
+type BCMInterface struct {
+	ifName string
+	socket int
+}
+
+// NewBCMInterface creates a new broadcast manager socket for the CAN interface
+func NewBCMInterface(interfaceName string) (*BCMInterface, error) {
+	socket, err := unix.Socket(unix.AF_CAN, unix.SOCK_DGRAM, unix.CAN_BCM)
+	if err != nil {
+		return nil, err
+	}
+	ifindex, err := ifIndex(socket, interfaceName)
+	if err != nil {
+		unix.Close(socket)
+		return nil, err
+	}
+	addr := &unix.SockaddrCAN{Ifindex: ifindex}
+	if err = unix.Connect(socket, addr); err != nil {
+		unix.Close(socket)
+		return nil, err
+	}
+	return &BCMInterface{ifName: interfaceName, socket: socket}, nil
+}
+
+// Close closes the broadcast manager socket. The kernel removes all tasks of the socket.
+func (b *BCMInterface) Close() error {
+	return unix.Close(b.socket)
+}
+
+// SetReceiveTimeout sets the maximum time Receive blocks (SO_RCVTIMEO).
+// If the timeout expires, Receive returns ErrReceiveTimeout. 0 means no timeout.
+func (b *BCMInterface) SetReceiveTimeout(d time.Duration) error {
+	tv := unix.NsecToTimeval(d.Nanoseconds())
+	return unix.SetsockoptTimeval(b.socket, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+}
+
+// Send sends a message to the broadcast manager
+func (b *BCMInterface) Send(m *BCMMessage) error {
+	msgBytes, err := marshalBCMMessage(m)
+	if err != nil {
+		return err
+	}
+	_, err = unix.Write(b.socket, msgBytes)
+	return err
+}
+
+// Receive receives a message from the broadcast manager, e.g. BCMRxChanged or BCMRxTimeout.
+// Blocking read
+func (b *BCMInterface) Receive() (*BCMMessage, error) {
+	// large enough for the maximum number of frames of a message (256 CAN FD frames)
+	msgBytes := make([]byte, bcmHeadSize+256*canFDMTU)
+	n, err := unix.Read(b.socket, msgBytes)
+	if err == unix.EAGAIN {
+		return nil, ErrReceiveTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalBCMMessage(msgBytes[:n])
+}
+
+// TxSetup starts the cyclic transmission of the frames with interval.
+// If more than one frame is passed, the frames are sent one after the other (multiplex).
+// The ID of the task is taken from the first frame. Calling TxSetup again for the same ID updates the frames
+// and the interval.
+func (b *BCMInterface) TxSetup(interval time.Duration, frames ...*CANFrame) error {
+	if len(frames) == 0 {
+		return errors.New("no frames to send")
+	}
+	return b.Send(&BCMMessage{
+		Opcode:    BCMTxSetup,
+		Flags:     BCMSetTimer | BCMStartTimer,
+		Interval2: interval,
+		ID:        frames[0].ID,
+		Extended:  frames[0].Extended,
+		Frames:    frames,
+	})
+}
+
+// TxDelete stops the cyclic transmission of the frames with id
+func (b *BCMInterface) TxDelete(id uint32, extended bool) error {
+	return b.Send(&BCMMessage{Opcode: BCMTxDelete, ID: id, Extended: extended})
+}
+
+// RxSetup subscribes to frames with id.
+//
+// If mask is nil, each received frame is reported with BCMRxChanged. Otherwise, only frames whose data
+// masked with mask.Data differ from the previous frame are reported.
+// If timeout is not 0, BCMRxTimeout is reported when no frame has been received for timeout.
+// If throttle is not 0, changes are reported at most once per throttle interval.
+func (b *BCMInterface) RxSetup(id uint32, extended bool, mask *CANFrame, timeout time.Duration, throttle time.Duration) error {
+	m := &BCMMessage{
+		Opcode:    BCMRxSetup,
+		Interval1: timeout,
+		Interval2: throttle,
+		ID:        id,
+		Extended:  extended,
+	}
+	if timeout != 0 || throttle != 0 {
+		m.Flags |= BCMSetTimer | BCMStartTimer
+	}
+	if mask == nil {
+		m.Flags |= BCMRxFilterID
+	} else {
+		m.Flags |= BCMRxCheckDLC
+		m.Frames = []*CANFrame{mask}
+	}
+	return b.Send(m)
+}
+
+// RxDelete removes the subscription for frames with id
+func (b *BCMInterface) RxDelete(id uint32, extended bool) error {
+	return b.Send(&BCMMessage{Opcode: BCMRxDelete, ID: id, Extended: extended})
+}
+
+// marshalBCMMessage converts m into a struct bcm_msg_head followed by struct can_frame or struct canfd_frame
+func marshalBCMMessage(m *BCMMessage) ([]byte, error) {
+	flags := m.Flags
+	frameSize := canMTU
+	if len(m.Frames) > 0 && m.Frames[0].FD {
+		flags |= BCMCANFDFrame
+		frameSize = canFDMTU
+	}
+	msgBytes := make([]byte, bcmHeadSize, bcmHeadSize+len(m.Frames)*frameSize)
+
+	binary.LittleEndian.PutUint32(msgBytes[0:4], uint32(m.Opcode))
+	binary.LittleEndian.PutUint32(msgBytes[4:8], uint32(flags))
+	binary.LittleEndian.PutUint32(msgBytes[8:12], m.Count)
+	off := putBCMTimeval(msgBytes, bcmTimevalOffset, m.Interval1)
+	off = putBCMTimeval(msgBytes, off, m.Interval2)
+	id := m.ID
+	if m.Extended {
+		id |= canEFFFlag
+	}
+	binary.LittleEndian.PutUint32(msgBytes[off:off+4], id)
+	binary.LittleEndian.PutUint32(msgBytes[off+4:off+8], uint32(len(m.Frames)))
+
+	for _, f := range m.Frames {
+		if f.FD != (frameSize == canFDMTU) {
+			return nil, errors.New("can't mix classic and CAN FD frames in one BCM message")
+		}
+		frameBytes, err := marshalFrame(f)
+		if err != nil {
+			return nil, err
+		}
+		msgBytes = append(msgBytes, frameBytes...)
+	}
+	return msgBytes, nil
+}
+
+// unmarshalBCMMessage converts a struct bcm_msg_head followed by frames into a BCMMessage
+func unmarshalBCMMessage(msgBytes []byte) (*BCMMessage, error) {
+	if len(msgBytes) < bcmHeadSize {
+		return nil, fmt.Errorf("unexpected BCM message size %d", len(msgBytes))
+	}
+	m := &BCMMessage{
+		Opcode: BCMOpcode(binary.LittleEndian.Uint32(msgBytes[0:4])),
+		Flags:  BCMFlags(binary.LittleEndian.Uint32(msgBytes[4:8])),
+		Count:  binary.LittleEndian.Uint32(msgBytes[8:12]),
+	}
+	var off int
+	m.Interval1, off = getBCMTimeval(msgBytes, bcmTimevalOffset)
+	m.Interval2, off = getBCMTimeval(msgBytes, off)
+	id := binary.LittleEndian.Uint32(msgBytes[off : off+4])
+	nFrames := int(binary.LittleEndian.Uint32(msgBytes[off+4 : off+8]))
+	m.Extended = id&canEFFFlag != 0
+	if m.Extended {
+		m.ID = id & 0x1FFFFFFF
+	} else {
+		m.ID = id & 0x7FF
+	}
+
+	frameSize := canMTU
+	if m.Flags&BCMCANFDFrame != 0 {
+		frameSize = canFDMTU
+	}
+	if len(msgBytes) != bcmHeadSize+nFrames*frameSize {
+		return nil, fmt.Errorf("unexpected BCM message size %d for %d frames", len(msgBytes), nFrames)
+	}
+	for i := 0; i < nFrames; i++ {
+		start := bcmHeadSize + i*frameSize
+		m.Frames = append(m.Frames, unmarshalFrame(msgBytes[start:start+frameSize]))
+	}
+	return m, nil
+}
+
+func putBCMTimeval(b []byte, off int, d time.Duration) int {
+	tv := unix.NsecToTimeval(d.Nanoseconds())
+	putLong(b[off:], int64(tv.Sec))
+	putLong(b[off+longSize:], int64(tv.Usec))
+	return off + 2*longSize
+}
+
+func getBCMTimeval(b []byte, off int) (time.Duration, int) {
+	sec := getLong(b[off:])
+	usec := getLong(b[off+longSize:])
+	return time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond, off + 2*longSize
+}
+
+func putLong(b []byte, v int64) {
+	if longSize == 8 {
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	} else {
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	}
+}
+
+func getLong(b []byte) int64 {
+	if longSize == 8 {
+		return int64(binary.LittleEndian.Uint64(b))
+	}
+	return int64(int32(binary.LittleEndian.Uint32(b)))
+}
@@ -0,0 +1,82 @@
+package socketcan
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalBCMMessage(t *testing.T) {
+	m := &BCMMessage{
+		Opcode:    BCMRxSetup,
+		Flags:     BCMSetTimer | BCMStartTimer,
+		Interval1: 1500 * time.Millisecond,
+		Interval2: 100 * time.Millisecond,
+		ID:        0x1abcdef,
+		Extended:  true,
+		Frames:    []*CANFrame{{ID: 0x1abcdef, Extended: true, DLC: 2, Data: []byte{0xff, 0x0f}}},
+	}
+	b, err := marshalBCMMessage(m)
+	assert.Nil(t, err)
+	assert.Equal(t, bcmHeadSize+canMTU, len(b))
+	if longSize == 8 {
+		assert.Equal(t, 56, bcmHeadSize)
+		// ival1.tv_sec, ival1.tv_usec
+		assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(b[16:24]))
+		assert.Equal(t, uint64(500000), binary.LittleEndian.Uint64(b[24:32]))
+		// can_id, nframes
+		assert.Equal(t, uint32(0x1abcdef|canEFFFlag), binary.LittleEndian.Uint32(b[48:52]))
+		assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(b[52:56]))
+	}
+
+	r, err := unmarshalBCMMessage(b)
+	assert.Nil(t, err)
+	assert.Equal(t, BCMRxSetup, r.Opcode)
+	assert.Equal(t, m.Flags, r.Flags)
+	assert.Equal(t, m.Interval1, r.Interval1)
+	assert.Equal(t, m.Interval2, r.Interval2)
+	assert.Equal(t, uint32(0x1abcdef), r.ID)
+	assert.True(t, r.Extended)
+	assert.Equal(t, 1, len(r.Frames))
+	assert.Equal(t, []byte{0xff, 0x0f, 0, 0, 0, 0, 0, 0}, r.Frames[0].Data)
+
+	_, err = unmarshalBCMMessage(b[:len(b)-1])
+	assert.NotNil(t, err)
+}
+
+func TestMarshalBCMMessageFD(t *testing.T) {
+	m := &BCMMessage{
+		Opcode: BCMTxSetup,
+		ID:     0x123,
+		Frames: []*CANFrame{{ID: 0x123, DLC: 12, Data: make([]byte, 12), FD: true}},
+	}
+	b, err := marshalBCMMessage(m)
+	assert.Nil(t, err)
+	assert.Equal(t, bcmHeadSize+canFDMTU, len(b))
+
+	r, err := unmarshalBCMMessage(b)
+	assert.Nil(t, err)
+	assert.Equal(t, BCMCANFDFrame, r.Flags&BCMCANFDFrame)
+	assert.True(t, r.Frames[0].FD)
+
+	m.Frames = append(m.Frames, &CANFrame{ID: 0x123, DLC: 1, Data: []byte{1}})
+	_, err = marshalBCMMessage(m)
+	assert.NotNil(t, err)
+}
+
+func TestBCMRxTimeout(t *testing.T) {
+	b, err := NewBCMInterface("vcan0")
+	if err != nil {
+		t.Skipf("vcan0 not available: %v", err)
+	}
+	defer b.Close()
+
+	assert.Nil(t, b.SetReceiveTimeout(time.Second))
+	assert.Nil(t, b.RxSetup(0x321, false, nil, 50*time.Millisecond, 0))
+	m, err := b.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, BCMRxTimeout, m.Opcode)
+	assert.Equal(t, uint32(0x321), m.ID)
+}
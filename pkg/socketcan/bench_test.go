@@ -0,0 +1,73 @@
+package socketcan
+
+import (
+	"testing"
+)
+
+const benchBatchSize = 30
+
+// newBenchInterfaces opens a sender and a receiver on vcan0. The benchmark is skipped if vcan0 is not available.
+func newBenchInterfaces(b *testing.B) (tx *RawInterface, rx *RawInterface) {
+	tx, err := NewRawInterface("vcan0")
+	if err != nil {
+		b.Skipf("vcan0 not available: %v", err)
+	}
+	rx, err = NewRawInterface("vcan0")
+	if err != nil {
+		tx.Close()
+		b.Skipf("vcan0 not available: %v", err)
+	}
+	b.Cleanup(func() {
+		tx.Close()
+		rx.Close()
+	})
+	return tx, rx
+}
+
+func benchFrames(n int) []*CANFrame {
+	frames := make([]*CANFrame, n)
+	for k := range frames {
+		frames[k] = &CANFrame{ID: 0x100 + uint32(k), DLC: 8, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	}
+	return frames
+}
+
+func BenchmarkSendReceive(b *testing.B) {
+	tx, rx := newBenchInterfaces(b)
+	frames := benchFrames(benchBatchSize)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, f := range frames {
+			if err := tx.Send(f); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for range frames {
+			if _, err := rx.Receive(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.SetBytes(int64(len(frames) * canMTU))
+}
+
+func BenchmarkSendReceiveBatch(b *testing.B) {
+	tx, rx := newBenchInterfaces(b)
+	frames := benchFrames(benchBatchSize)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := tx.SendBatch(frames); err != nil {
+			b.Fatal(err)
+		}
+		for received := 0; received < len(frames); {
+			f, err := rx.ReceiveBatch(len(frames) - received)
+			if err != nil {
+				b.Fatal(err)
+			}
+			received += len(f)
+		}
+	}
+	b.SetBytes(int64(len(frames) * canMTU))
+}
@@ -0,0 +1,205 @@
+package socketcan
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// CANProtErrorType is the type of a protocol violation (data[2], when CANErrProt is set in CANErrorClass).
+type CANProtErrorType uint8
+
+// CANProtErrorLocation is the location of a protocol violation (data[3], when CANErrProt is set in CANErrorClass).
+type CANProtErrorLocation uint8
+
+// CANTrxStatus is the transceiver status (data[4], when CANErrTrx is set in CANErrorClass).
+type CANTrxStatus uint8
+
+const (
+	// CANErrProtUnspec flags unspecified
+	CANErrProtUnspec CANProtErrorType = 0x00
+	// CANErrProtBit flags single bit error
+	CANErrProtBit CANProtErrorType = 0x01
+	// CANErrProtForm flags frame format error
+	CANErrProtForm CANProtErrorType = 0x02
+	// CANErrProtStuff flags bit stuffing error
+	CANErrProtStuff CANProtErrorType = 0x04
+	// CANErrProtBit0 flags unable to send dominant bit
+	CANErrProtBit0 CANProtErrorType = 0x08
+	// CANErrProtBit1 flags unable to send recessive bit
+	CANErrProtBit1 CANProtErrorType = 0x10
+	// CANErrProtOverload flags bus overload
+	CANErrProtOverload CANProtErrorType = 0x20
+	// CANErrProtActive flags active error announcement
+	CANErrProtActive CANProtErrorType = 0x40
+	// CANErrProtTx flags error occurred on transmission
+	CANErrProtTx CANProtErrorType = 0x80
+)
+
+// protocol error locations, see CAN_ERR_PROT_LOC_* in linux/can/error.h
+const (
+	CANErrProtLocUnspec  CANProtErrorLocation = 0x00
+	CANErrProtLocSOF     CANProtErrorLocation = 0x03
+	CANErrProtLocID28_21 CANProtErrorLocation = 0x02
+	CANErrProtLocID20_18 CANProtErrorLocation = 0x06
+	CANErrProtLocSRTR    CANProtErrorLocation = 0x04
+	CANErrProtLocIDE     CANProtErrorLocation = 0x05
+	CANErrProtLocID17_13 CANProtErrorLocation = 0x07
+	CANErrProtLocID12_05 CANProtErrorLocation = 0x0F
+	CANErrProtLocID04_00 CANProtErrorLocation = 0x0E
+	CANErrProtLocRTR     CANProtErrorLocation = 0x0C
+	CANErrProtLocRES1    CANProtErrorLocation = 0x0D
+	CANErrProtLocRES0    CANProtErrorLocation = 0x09
+	CANErrProtLocDLC     CANProtErrorLocation = 0x0B
+	CANErrProtLocData    CANProtErrorLocation = 0x0A
+	CANErrProtLocCRCSeq  CANProtErrorLocation = 0x08
+	CANErrProtLocCRCDel  CANProtErrorLocation = 0x18
+	CANErrProtLocACK     CANProtErrorLocation = 0x19
+	CANErrProtLocACKDel  CANProtErrorLocation = 0x1B
+	CANErrProtLocEOF     CANProtErrorLocation = 0x1A
+	CANErrProtLocInterm  CANProtErrorLocation = 0x12
+)
+
+// transceiver states, see CAN_ERR_TRX_* in linux/can/error.h
+const (
+	CANErrTrxUnspec          CANTrxStatus = 0x00
+	CANErrTrxCANHNoWire      CANTrxStatus = 0x04
+	CANErrTrxCANHShortToBat  CANTrxStatus = 0x05
+	CANErrTrxCANHShortToVCC  CANTrxStatus = 0x06
+	CANErrTrxCANHShortToGND  CANTrxStatus = 0x07
+	CANErrTrxCANLNoWire      CANTrxStatus = 0x40
+	CANErrTrxCANLShortToBat  CANTrxStatus = 0x50
+	CANErrTrxCANLShortToVCC  CANTrxStatus = 0x60
+	CANErrTrxCANLShortToGND  CANTrxStatus = 0x70
+	CANErrTrxCANLShortToCANH CANTrxStatus = 0x80
+)
+
+const (
+	// canErrDLC is the data length code of error frames
+	canErrDLC = 8
+	// canErrMask masks the error class in the ID of error frames
+	canErrMask = 0x1FFFFFFF
+)
+
+// CANErrorFrame represents a CAN error frame.
+// The fields correspond to the data bytes of the frame as defined in linux/can/error.h.
+type CANErrorFrame struct {
+	ErrorClass CANErrorClass
+	// data[0]: bit number in the bitstream where arbitration was lost (CANErrLostArb), 0 if unspecified
+	ArbitrationLostBit uint8
+	// data[1]: controller problems (CANErrCtrl)
+	CANCtrlErrorDetails CANCtrlErrorDetails
+	// data[2]: type of protocol violation (CANErrProt)
+	ProtocolErrorType CANProtErrorType
+	// data[3]: location of protocol violation (CANErrProt)
+	ProtocolErrorLocation CANProtErrorLocation
+	// data[4]: transceiver status (CANErrTrx)
+	TransceiverStatus CANTrxStatus
+	// data[5]: controller specific additional information
+	ControllerSpecific uint8
+	// data[6], data[7]: TX and RX error counters, only valid if CANErrCnt is set in ErrorClass
+	TxErrorCounter uint8
+	RxErrorCounter uint8
+}
+
+// marshalErrorFrame converts f into a struct can_frame
+func marshalErrorFrame(f *CANErrorFrame) []byte {
+	frameBytes := make([]byte, canMTU)
+
+	// bytes 0-3: ID
+	binary.LittleEndian.PutUint32(frameBytes[0:4], uint32(f.ErrorClass|canErrFlag))
+	// byte 4: data length code
+	frameBytes[4] = canErrDLC
+	// bytes 8-15: data
+	frameBytes[8] = f.ArbitrationLostBit
+	frameBytes[9] = byte(f.CANCtrlErrorDetails)
+	frameBytes[10] = byte(f.ProtocolErrorType)
+	frameBytes[11] = byte(f.ProtocolErrorLocation)
+	frameBytes[12] = byte(f.TransceiverStatus)
+	frameBytes[13] = f.ControllerSpecific
+	if f.ErrorClass&CANErrCnt != 0 {
+		frameBytes[14] = f.TxErrorCounter
+		frameBytes[15] = f.RxErrorCounter
+	}
+	return frameBytes
+}
+
+// unmarshalErrorFrame converts a struct can_frame with CAN_ERR_FLAG set into a CANErrorFrame
+func unmarshalErrorFrame(frameBytes []byte) *CANErrorFrame {
+	id := binary.LittleEndian.Uint32(frameBytes[0:4])
+	d := frameBytes[8:16]
+	return &CANErrorFrame{
+		ErrorClass:            CANErrorClass(id & canErrMask),
+		ArbitrationLostBit:    d[0],
+		CANCtrlErrorDetails:   CANCtrlErrorDetails(d[1]),
+		ProtocolErrorType:     CANProtErrorType(d[2]),
+		ProtocolErrorLocation: CANProtErrorLocation(d[3]),
+		TransceiverStatus:     CANTrxStatus(d[4]),
+		ControllerSpecific:    d[5],
+		TxErrorCounter:        d[6],
+		RxErrorCounter:        d[7],
+	}
+}
+
+var errorClassNames = []struct {
+	class CANErrorClass
+	name  string
+}{
+	{CANErrTxTimeout, "tx-timeout"},
+	{CANErrLostArb, "lost-arbitration"},
+	{CANErrCtrl, "controller-problem"},
+	{CANErrProt, "protocol-violation"},
+	{CANErrTrx, "transceiver-status"},
+	{CANErrAck, "no-acknowledgement"},
+	{CANErrBusOff, "bus-off"},
+	{CANErrBusError, "bus-error"},
+	{CANErrRestarted, "restarted-after-bus-off"},
+	{CANErrCnt, "error-counter"},
+}
+
+var ctrlErrorNames = []struct {
+	details CANCtrlErrorDetails
+	name    string
+}{
+	{CANErrCtrlRxOverflow, "rx-overflow"},
+	{CANErrCtrlTxOverflow, "tx-overflow"},
+	{CANErrCtrlRxWarning, "rx-error-warning"},
+	{CANErrCtrlTxWarning, "tx-error-warning"},
+	{CANErrCtrlRxPassive, "rx-error-passive"},
+	{CANErrCtrlTxPassive, "tx-error-passive"},
+	{CANErrCtrlActive, "back-to-error-active"},
+}
+
+// String returns the error classes and details in the style of candump -e
+func (f *CANErrorFrame) String() string {
+	classes := []string{}
+	for _, c := range errorClassNames {
+		if f.ErrorClass&c.class != 0 {
+			classes = append(classes, c.name)
+		}
+	}
+	s := "error frame: " + strings.Join(classes, ",")
+
+	if f.ErrorClass&CANErrLostArb != 0 && f.ArbitrationLostBit != 0 {
+		s += fmt.Sprintf(" lost-arbitration-bit %d", f.ArbitrationLostBit)
+	}
+	if f.ErrorClass&CANErrCtrl != 0 {
+		details := []string{}
+		for _, c := range ctrlErrorNames {
+			if f.CANCtrlErrorDetails&c.details != 0 {
+				details = append(details, c.name)
+			}
+		}
+		s += " controller {" + strings.Join(details, ",") + "}"
+	}
+	if f.ErrorClass&CANErrProt != 0 {
+		s += fmt.Sprintf(" protocol {type 0x%02x, location 0x%02x}", f.ProtocolErrorType, f.ProtocolErrorLocation)
+	}
+	if f.ErrorClass&CANErrTrx != 0 {
+		s += fmt.Sprintf(" transceiver 0x%02x", f.TransceiverStatus)
+	}
+	if f.ErrorClass&CANErrCnt != 0 {
+		s += fmt.Sprintf(" error-counter-tx-rx {%d,%d}", f.TxErrorCounter, f.RxErrorCounter)
+	}
+	return s
+}
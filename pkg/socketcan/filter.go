@@ -0,0 +1,110 @@
+package socketcan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CANFilter represents a kernel receive filter (struct can_filter).
+// A received frame matches, if <received_can_id> & Mask == ID & Mask.
+// ID and Mask are raw socketcan IDs, i.e. they may contain the EFF and RTR flags.
+type CANFilter struct {
+	ID       uint32
+	Mask     uint32
+	Inverted bool // frame matches if the condition above is NOT true
+}
+
+// SetFilters installs the receive filters on the socket (CAN_RAW_FILTER).
+// A frame is received if it matches any of the filters.
+// An empty filter list disables the reception of frames completely.
+// Returns ErrClosed if the interface has been closed.
+func (i *RawInterface) SetFilters(filters []CANFilter) error {
+	if len(filters) > unix.CAN_RAW_FILTER_MAX {
+		return fmt.Errorf("too many filters (max %d)", unix.CAN_RAW_FILTER_MAX)
+	}
+	kFilters := make([]unix.CanFilter, len(filters))
+	for n, f := range filters {
+		kFilters[n].Id = f.ID
+		kFilters[n].Mask = f.Mask
+		if f.Inverted {
+			kFilters[n].Id |= unix.CAN_INV_FILTER
+		}
+	}
+	err := i.control(func(fd int) error {
+		return unix.SetsockoptCanRawFilter(fd, unix.SOL_CAN_RAW, unix.CAN_RAW_FILTER, kFilters)
+	})
+	if err == ErrClosed {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("can't set CAN filters: %v", err)
+	}
+	return nil
+}
+
+// SetErrorFilter defines which classes of error frames are received (CAN_RAW_ERR_FILTER).
+// By default, no error frames are received. Returns ErrClosed if the interface has been closed.
+func (i *RawInterface) SetErrorFilter(mask CANErrorClass) error {
+	err := i.control(func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_CAN_RAW, unix.CAN_RAW_ERR_FILTER, int(mask&unix.CAN_ERR_MASK))
+	})
+	if err == ErrClosed {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("can't set CAN error filter: %v", err)
+	}
+	return nil
+}
+
+// ParseFilters parses a comma separated filter list in candump syntax:
+//   - <can_id>:<can_mask> matches when <received_can_id> & mask == can_id & mask
+//   - <can_id>~<can_mask> matches when <received_can_id> & mask != can_id & mask
+//   - #<error_mask> sets the error class filter
+//
+// All values are hexadecimal. If can_id has 8 digits, the filter applies to extended frames.
+// Returns the filters (nil if only an error mask is specified) and the error mask (0 if not specified).
+func ParseFilters(s string) ([]CANFilter, CANErrorClass, error) {
+	var filters []CANFilter
+	var errMask CANErrorClass
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.HasPrefix(item, "#") {
+			v, err := strconv.ParseUint(item[1:], 16, 32)
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid error mask %s: %v", item, err)
+			}
+			errMask = CANErrorClass(v)
+			continue
+		}
+		sep := strings.IndexAny(item, ":~")
+		if sep < 0 {
+			return nil, 0, fmt.Errorf("invalid filter %s: expected <id>:<mask> or <id>~<mask>", item)
+		}
+		id, err := strconv.ParseUint(item[:sep], 16, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid filter id %s: %v", item, err)
+		}
+		mask, err := strconv.ParseUint(item[sep+1:], 16, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid filter mask %s: %v", item, err)
+		}
+		f := CANFilter{
+			ID:       uint32(id),
+			Mask:     uint32(mask) &^ canErrFlag,
+			Inverted: item[sep] == '~',
+		}
+		if sep == 8 {
+			f.ID |= canEFFFlag
+		}
+		filters = append(filters, f)
+	}
+	return filters, errMask, nil
+}
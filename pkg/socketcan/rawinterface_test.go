@@ -0,0 +1,193 @@
+package socketcan
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// newTestInterface returns a RawInterface on one end of a datagram socket pair and the fd of the other end
+func newTestInterface(t *testing.T) (*RawInterface, int) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	assert.Nil(t, err)
+	i := &RawInterface{ifName: "test"}
+	assert.Nil(t, i.setSocket(fds[0]))
+	t.Cleanup(func() {
+		i.Close()
+		unix.Close(fds[1])
+	})
+	return i, fds[1]
+}
+
+func TestReceiveDeadline(t *testing.T) {
+	i, peer := newTestInterface(t)
+
+	b, err := marshalFrame(&CANFrame{ID: 0x123, DLC: 1, Data: []byte{1}})
+	assert.Nil(t, err)
+	_, err = unix.Write(peer, b)
+	assert.Nil(t, err)
+	f, err := i.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0x123), f.ID)
+
+	assert.Nil(t, i.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err = i.Receive()
+	assert.Equal(t, ErrReceiveTimeout, err)
+	assert.Nil(t, i.SetReadDeadline(time.Time{}))
+
+	assert.Nil(t, i.SetReceiveTimeout(20*time.Millisecond))
+	_, err = i.Receive()
+	assert.Equal(t, ErrReceiveTimeout, err)
+}
+
+func TestReceiveContext(t *testing.T) {
+	i, peer := newTestInterface(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := i.ReceiveContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err = i.ReceiveContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	// the read deadline is cleared after cancellation
+	b, err := marshalFrame(&CANFrame{ID: 0x7FF, DLC: 0})
+	assert.Nil(t, err)
+	_, err = unix.Write(peer, b)
+	assert.Nil(t, err)
+	f, err := i.ReceiveContext(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0x7FF), f.ID)
+}
+
+func TestCloseUnblocksReceive(t *testing.T) {
+	i, _ := newTestInterface(t)
+
+	errCh := make(chan error)
+	go func() {
+		_, err := i.Receive()
+		errCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, i.Close())
+	select {
+	case err := <-errCh:
+		assert.Equal(t, ErrClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("Receive not unblocked by Close")
+	}
+}
+
+func TestSocketOptionsAfterClose(t *testing.T) {
+	i, _ := newTestInterface(t)
+
+	assert.Nil(t, i.Close())
+	assert.Equal(t, ErrClosed, i.SetFilters([]CANFilter{{ID: 0x123, Mask: 0x7FF}}))
+	assert.Equal(t, ErrClosed, i.SetErrorFilter(CANErrBusOff))
+}
+
+func TestReceiveBatch(t *testing.T) {
+	i, peer := newTestInterface(t)
+
+	for n := 0; n < 40; n++ {
+		f := &CANFrame{ID: uint32(n), DLC: 1, Data: []byte{byte(n)}}
+		if n == 5 {
+			f.ID |= canErrFlag
+		}
+		if n == 7 {
+			f = &CANFrame{ID: uint32(n), FD: true, DLC: 12, Data: testFDData(12)}
+		}
+		b, err := marshalFrameAllowErr(f)
+		assert.Nil(t, err)
+		_, err = unix.Write(peer, b)
+		assert.Nil(t, err)
+	}
+
+	// the error frame is skipped
+	frames, err := i.ReceiveBatch(30)
+	assert.Nil(t, err)
+	assert.Equal(t, 29, len(frames))
+	assert.Equal(t, uint32(6), frames[5].ID)
+	assert.True(t, frames[6].FD)
+	assert.Equal(t, testFDData(12), frames[6].Data[:12])
+
+	frames, err = i.ReceiveBatch(30)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(frames))
+	assert.Equal(t, uint32(30), frames[0].ID)
+
+	assert.Nil(t, i.SetReceiveTimeout(20*time.Millisecond))
+	_, err = i.ReceiveBatch(30)
+	assert.Equal(t, ErrReceiveTimeout, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = i.ReceiveBatchContext(ctx, 30)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestSendBatch(t *testing.T) {
+	i, peer := newTestInterface(t)
+
+	frames := make([]*CANFrame, 0, 100)
+	for n := 0; n < 100; n++ {
+		frames = append(frames, &CANFrame{ID: uint32(n), DLC: 2, Data: []byte{byte(n), 0xAA}})
+	}
+	sent, err := i.SendBatch(frames)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, sent)
+
+	b := make([]byte, canFDMTU)
+	for n := 0; n < 100; n++ {
+		size, err := unix.Read(peer, b)
+		assert.Nil(t, err)
+		assert.Equal(t, canMTU, size)
+		f := unmarshalFrame(b[:size])
+		assert.Equal(t, uint32(n), f.ID)
+		assert.Equal(t, []byte{byte(n), 0xAA}, f.Data[:f.DLC])
+	}
+
+	// the frames before an invalid frame are sent
+	frames = []*CANFrame{
+		{ID: 0x100, DLC: 1, Data: []byte{1}},
+		{ID: 0x101, FD: true, DLC: 1, Data: []byte{2}},
+		{ID: 0x102, DLC: 1, Data: []byte{3}},
+	}
+	sent, err = i.SendBatch(frames)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, sent)
+	size, err := unix.Read(peer, b)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0x100), unmarshalFrame(b[:size]).ID)
+}
+
+func testFDData(n int) []byte {
+	data := make([]byte, n)
+	for k := range data {
+		data[k] = byte(k + 1)
+	}
+	return data
+}
+
+// marshalFrameAllowErr marshals f like marshalFrame, but keeps the error flag of f.ID
+func marshalFrameAllowErr(f *CANFrame) ([]byte, error) {
+	errFlag := f.ID & canErrFlag
+	g := *f
+	g.ID &^= canErrFlag
+	b, err := marshalFrame(&g)
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(b[0:4], binary.LittleEndian.Uint32(b[0:4])|errFlag)
+	return b, nil
+}
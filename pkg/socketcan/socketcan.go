@@ -1,21 +1,42 @@
 package socketcan
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	"log"
 
 	"golang.org/x/sys/unix"
 )
 
+var (
+	// ErrReceiveTimeout is returned by Receive if no frame has been received within the receive timeout or before the read deadline
+	ErrReceiveTimeout = errors.New("receive timeout")
+	// ErrSendTimeout is returned by Send if the frame could not be written before the write deadline
+	ErrSendTimeout = errors.New("send timeout")
+	// ErrClosed is returned by Receive and Send if the interface has been closed
+	ErrClosed = errors.New("socketcan interface closed")
+)
+
 // CANFrame represents a CAN frame.
+// For CAN FD frames, DLC contains the payload length in bytes (0..64).
 type CANFrame struct {
 	ID       uint32
 	DLC      uint8
 	Data     []byte
 	Extended bool
 	RTR      bool
+	FD       bool // frame is a CAN FD frame
+	BRS      bool // CAN FD bit rate switch
+	ESI      bool // CAN FD error state indicator
+	// Timestamp is the receive time of the frame, if known. Not used by Send
+	Timestamp time.Time
 }
 
 // CANErrorClass represents athe CAN error class.
@@ -43,6 +64,8 @@ const (
 	CANErrBusError CANErrorClass = 0x00000080
 	// CANErrRestarted flags controller restarted
 	CANErrRestarted CANErrorClass = 0x00000100
+	// CANErrCnt flags that TX and RX error counters are valid
+	CANErrCnt CANErrorClass = 0x00000200
 
 	// CANErrCtrlUnspec flags unspecified
 	CANErrCtrlUnspec CANCtrlErrorDetails = 0x00
@@ -58,17 +81,24 @@ const (
 	CANErrCtrlRxPassive CANCtrlErrorDetails = 0x10
 	// CANErrCtrlTxPassive flags reached error passive status TX
 	CANErrCtrlTxPassive CANCtrlErrorDetails = 0x20
+	// CANErrCtrlActive flags recovered to error active state
+	CANErrCtrlActive CANCtrlErrorDetails = 0x40
 
 	canErrFlag = 0x20000000
 	canRTRFlag = 0x40000000
 	canEFFFlag = 0x80000000
-)
 
-// CANErrorFrame represents a CAN error frame.
-type CANErrorFrame struct {
-	ErrorClass          CANErrorClass
-	CANCtrlErrorDetails CANCtrlErrorDetails
-}
+	canFDBRSFlag = 0x01
+	canFDESIFlag = 0x02
+
+	// CANMaxDLen is the maximum payload length of a classic CAN frame
+	CANMaxDLen = 8
+	// CANFDMaxDLen is the maximum payload length of a CAN FD frame
+	CANFDMaxDLen = 64
+
+	canMTU   = 16 // sizeof(struct can_frame)
+	canFDMTU = 72 // sizeof(struct canfd_frame)
+)
 
 func (f *CANFrame) String() string {
 	var s string
@@ -81,6 +111,16 @@ func (f *CANFrame) String() string {
 	if f.RTR {
 		s += " (RTR)"
 	}
+	if f.FD {
+		s += " (FD"
+		if f.BRS {
+			s += ",BRS"
+		}
+		if f.ESI {
+			s += ",ESI"
+		}
+		s += ")"
+	}
 
 	s += fmt.Sprintf(" DLC: %d, Data: ", f.DLC)
 	for i, b := range f.Data {
@@ -93,67 +133,134 @@ func (f *CANFrame) String() string {
 }
 
 // RawInterface represents a raw CAN interface.
+// The socket is non-blocking and integrated with the Go netpoller, so reads and writes can be
+// cancelled with deadlines, contexts and Close.
 type RawInterface struct {
 	ifName string
-	socket int
+	file   *os.File        // owns the socket
+	conn   syscall.RawConn // of file, for reads, writes and socket options
+	fdMode bool
+
+	mu        sync.Mutex
+	rxTimeout time.Duration
+	closed    bool
+
+	// preallocated buffers of ReceiveBatch and SendBatch
+	rxBatch batchBuffers
+	txBatch batchBuffers
+}
+
+// RawInterfaceOption is a type to pass options to NewRawInterface()
+type RawInterfaceOption func(*RawInterface)
+
+// WithFDMode may be passed to NewRawInterface.
+//
+// if enabled, CAN_RAW_FD_FRAMES is set on the socket, so that CAN FD frames can be sent and received
+// in addition to classic CAN frames.
+func WithFDMode(enable bool) RawInterfaceOption {
+	return func(i *RawInterface) {
+		i.fdMode = enable
+	}
 }
 
 // NewRawInterface creates a new raw CAN interface.
-func NewRawInterface(interfaceName string) (*RawInterface, error) {
-	socket, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW, unix.CAN_RAW)
+// Arguments may be one or more of the following functions:
+//   - WithFDMode
+func NewRawInterface(interfaceName string, opts ...RawInterfaceOption) (*RawInterface, error) {
+	i := &RawInterface{
+		ifName: interfaceName,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+
+	socket, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.CAN_RAW)
 	if err != nil {
 		return nil, err
 	}
+	if i.fdMode {
+		err = unix.SetsockoptInt(socket, unix.SOL_CAN_RAW, unix.CAN_RAW_FD_FRAMES, 1)
+		if err != nil {
+			unix.Close(socket)
+			return nil, fmt.Errorf("can't enable CAN FD frames: %v", err)
+		}
+	}
 	ifindex, err := ifIndex(socket, interfaceName)
 	if err != nil {
+		unix.Close(socket)
 		return nil, err
 	}
 	addr := &unix.SockaddrCAN{Ifindex: ifindex}
 	if err = unix.Bind(socket, addr); err != nil {
+		unix.Close(socket)
 		return nil, err
 	}
-	return &RawInterface{
-		ifName: interfaceName,
-		socket: socket,
-	}, nil
+	if err = i.setSocket(socket); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// setSocket registers the non-blocking socket with the netpoller. The interface takes ownership of socket.
+func (i *RawInterface) setSocket(socket int) error {
+	i.file = os.NewFile(uintptr(socket), "can:"+i.ifName)
+	var err error
+	i.conn, err = i.file.SyscallConn()
+	if err != nil {
+		i.file.Close()
+	}
+	return err
 }
 
-// Close closes the raw CAN interface.
+// FDMode returns true if the interface has been opened in CAN FD mode.
+func (i *RawInterface) FDMode() bool {
+	return i.fdMode
+}
+
+// SetReceiveTimeout sets the maximum time each Receive and ReceiveAny call blocks.
+// If the timeout expires, Receive returns ErrReceiveTimeout. 0 means no timeout.
+// If not 0, the timeout replaces the read deadline on each call.
+func (i *RawInterface) SetReceiveTimeout(d time.Duration) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rxTimeout = d
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Receive and ReceiveAny. When it is exceeded, they return ErrReceiveTimeout.
+// A zero value means no deadline.
+func (i *RawInterface) SetReadDeadline(t time.Time) error {
+	return i.ioError(i.file.SetReadDeadline(t), ErrReceiveTimeout)
+}
+
+// SetWriteDeadline sets the deadline for Send and SendErrorFrame. When it is exceeded, they return ErrSendTimeout.
+// A zero value means no deadline.
+func (i *RawInterface) SetWriteDeadline(t time.Time) error {
+	return i.ioError(i.file.SetWriteDeadline(t), ErrSendTimeout)
+}
+
+// Close closes the raw CAN interface. Pending Receive and Send calls return ErrClosed.
 func (i *RawInterface) Close() error {
-	return unix.Close(i.socket)
+	i.mu.Lock()
+	i.closed = true
+	i.mu.Unlock()
+	return i.file.Close()
 }
 
 // Send sends a CAN frame.
 // blocking write
 // Use this function for standard and extended frames.
+// CAN FD frames can only be sent if the interface has been opened in CAN FD mode.
 func (i *RawInterface) Send(f *CANFrame) error {
-	frameBytes := make([]byte, 16)
-	id := f.ID
-	if f.RTR {
-		id |= canRTRFlag
+	if f.FD && !i.fdMode {
+		return fmt.Errorf("can't send CAN FD frame, interface %s not in FD mode", i.ifName)
 	}
-
-	if !f.Extended {
-		// standard ID
-		if f.ID > 0x7FF {
-			return fmt.Errorf("ID %x is not a standard ID", f.ID)
-		}
-		binary.LittleEndian.PutUint32(frameBytes[0:4], id)
-	} else {
-		// extended ID
-		if f.ID > 0x1FFFFFFF {
-			return fmt.Errorf("ID %x is not an extended ID", f.ID)
-		}
-		id |= canEFFFlag
-		binary.LittleEndian.PutUint32(frameBytes[0:4], id)
+	frameBytes, err := marshalFrame(f)
+	if err != nil {
+		return err
 	}
 
-	// byte 4: data length code
-	frameBytes[4] = f.DLC
-	// data
-	copy(frameBytes[8:], f.Data)
-
-	_, err := unix.Write(i.socket, frameBytes)
+	err = i.write(frameBytes)
 	if err != nil {
 		log.Printf("Error writing to CAN socket: %v", err)
 	}
@@ -162,18 +269,7 @@ func (i *RawInterface) Send(f *CANFrame) error {
 
 // SendErrorFrame sends a CAN error frame.
 func (i *RawInterface) SendErrorFrame(f *CANErrorFrame) error {
-	frameBytes := make([]byte, 16)
-
-	id := uint32(f.ErrorClass | canErrFlag)
-	// bytes 0-3: ID
-	binary.LittleEndian.PutUint32(frameBytes[0:4], id)
-
-	// byte 4: data length code
-	frameBytes[4] = 8
-	// byte 9: Controller err details
-	frameBytes[9] = byte(f.CANCtrlErrorDetails)
-
-	_, err := unix.Write(i.socket, frameBytes)
+	err := i.write(marshalErrorFrame(f))
 	if err != nil {
 		log.Printf("Error writing to CAN socket: %v", err)
 	}
@@ -183,39 +279,288 @@ func (i *RawInterface) SendErrorFrame(f *CANErrorFrame) error {
 // Receive receives a CAN frame.
 // Blocking read
 // Handles only standard and extended frames, error frames are ignored
+// In CAN FD mode, both classic and CAN FD frames are returned.
 func (i *RawInterface) Receive() (*CANFrame, error) {
 	for {
-		f := CANFrame{}
-		frameBytes := make([]byte, 16)
-		_, err := unix.Read(i.socket, frameBytes)
+		f, _, err := i.ReceiveAny()
 		if err != nil {
 			return nil, err
 		}
+		if f != nil {
+			return f, nil
+		}
+	}
+}
 
-		// bytes 0-3: ID
-		id := uint32(binary.LittleEndian.Uint32(frameBytes[0:4]))
+// ReceiveAny receives a CAN frame or an error frame. Exactly one of the returned frames is non-nil if err is nil.
+// Blocking read
+// Error frames are only received if enabled with SetErrorFilter.
+func (i *RawInterface) ReceiveAny() (*CANFrame, *CANErrorFrame, error) {
+	if err := i.applyReceiveTimeout(); err != nil {
+		return nil, nil, err
+	}
+	return i.receiveAny()
+}
 
-		if id&canErrFlag == 0 { // ignore error frames
+// applyReceiveTimeout sets the read deadline if a receive timeout is set
+func (i *RawInterface) applyReceiveTimeout() error {
+	i.mu.Lock()
+	d := i.rxTimeout
+	i.mu.Unlock()
+	if d > 0 {
+		return i.SetReadDeadline(time.Now().Add(d))
+	}
+	return nil
+}
 
-			if id&canEFFFlag == 0 {
-				// standard ID
-				f.ID = id & 0x7FF
-			} else {
-				// extended ID
-				f.ID = id & 0x1FFFFFFF
-				f.Extended = true
-			}
-			if id&canRTRFlag != 0 {
-				f.RTR = true
+// ReceiveContext receives a CAN frame like Receive. It returns ctx.Err() when ctx is cancelled or its deadline expires.
+// The receive timeout is not used. ReceiveContext sets the read deadline and clears it on return.
+func (i *RawInterface) ReceiveContext(ctx context.Context) (*CANFrame, error) {
+	var f *CANFrame
+	err := i.withContext(ctx, func() error {
+		for {
+			var err error
+			f, _, err = i.receiveAny()
+			if err != nil || f != nil {
+				return err
 			}
+		}
+	})
+	return f, err
+}
+
+// withContext runs receive with the read deadline set from ctx. When ctx is cancelled, the read deadline
+// is moved to the past, so that receive returns. ErrReceiveTimeout is replaced by the error of ctx.
+func (i *RawInterface) withContext(ctx context.Context, receive func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := i.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	// unblock the read when ctx is cancelled
+	stop := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			i.file.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-watcherDone
+		i.file.SetReadDeadline(time.Time{})
+	}()
 
-			// byte 4: data length code
-			f.DLC = frameBytes[4]
-			// data
-			f.Data = make([]byte, 8)
-			copy(f.Data, frameBytes[8:])
+	err := receive()
+	if err == ErrReceiveTimeout {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the deadline of ctx expired before ctx noticed it
+		return context.DeadlineExceeded
+	}
+	return err
+}
 
-			return &f, nil
+// receiveAny reads the next frame until the read deadline
+func (i *RawInterface) receiveAny() (*CANFrame, *CANErrorFrame, error) {
+	frameBytes := make([]byte, canFDMTU)
+	n, err := i.read(frameBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n != canMTU && n != canFDMTU {
+		return nil, nil, fmt.Errorf("unexpected CAN frame size %d", n)
+	}
+
+	// bytes 0-3: ID
+	id := uint32(binary.LittleEndian.Uint32(frameBytes[0:4]))
+
+	if id&canErrFlag != 0 {
+		return nil, unmarshalErrorFrame(frameBytes[:n]), nil
+	}
+	return unmarshalFrame(frameBytes[:n]), nil, nil
+}
+
+// read reads from the socket, waiting in the netpoller until data is available or the read deadline expires
+func (i *RawInterface) read(b []byte) (int, error) {
+	var n int
+	var opErr error
+	err := i.conn.Read(func(fd uintptr) bool {
+		n, opErr = unix.Read(int(fd), b)
+		return opErr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, i.ioError(err, ErrReceiveTimeout)
+	}
+	return n, opErr
+}
+
+// write writes to the socket, waiting in the netpoller until the socket is writable or the write deadline expires
+func (i *RawInterface) write(b []byte) error {
+	var opErr error
+	err := i.conn.Write(func(fd uintptr) bool {
+		_, opErr = unix.Write(int(fd), b)
+		return opErr != unix.EAGAIN
+	})
+	if err != nil {
+		return i.ioError(err, ErrSendTimeout)
+	}
+	return opErr
+}
+
+// control calls fn with the socket, e.g. to set socket options. Returns ErrClosed if the interface has been closed.
+func (i *RawInterface) control(fn func(fd int) error) error {
+	var opErr error
+	err := i.conn.Control(func(fd uintptr) {
+		opErr = fn(int(fd))
+	})
+	if err != nil {
+		return i.ioError(err, err)
+	}
+	return opErr
+}
+
+// ioError maps the errors of the netpoller to the errors of this package
+func (i *RawInterface) ioError(err error, timeoutErr error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return timeoutErr
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return ErrClosed
+	}
+	return err
+}
+
+// marshalFrame converts f into a struct can_frame or, for FD frames, into a struct canfd_frame.
+func marshalFrame(f *CANFrame) ([]byte, error) {
+	frameBytes := make([]byte, canFDMTU)
+	n, err := marshalFrameInto(frameBytes, f)
+	if err != nil {
+		return nil, err
+	}
+	return frameBytes[:n], nil
+}
+
+// marshalFrameInto converts f like marshalFrame into frameBytes, which must have space for a struct canfd_frame.
+// Returns the size of the struct.
+func marshalFrameInto(frameBytes []byte, f *CANFrame) (int, error) {
+	id := f.ID
+	if f.RTR {
+		id |= canRTRFlag
+	}
+
+	if !f.Extended {
+		// standard ID
+		if f.ID > 0x7FF {
+			return 0, fmt.Errorf("ID %x is not a standard ID", f.ID)
+		}
+	} else {
+		// extended ID
+		if f.ID > 0x1FFFFFFF {
+			return 0, fmt.Errorf("ID %x is not an extended ID", f.ID)
+		}
+		id |= canEFFFlag
+	}
+
+	size := canMTU
+	if f.FD {
+		size = canFDMTU
+	}
+	// frameBytes may be reused
+	frameBytes = frameBytes[:size]
+	for n := range frameBytes {
+		frameBytes[n] = 0
+	}
+	if f.FD {
+		if f.DLC > CANFDMaxDLen {
+			return 0, fmt.Errorf("length %d exceeds CAN FD maximum", f.DLC)
+		}
+		// byte 4: payload length, rounded up to the next valid CAN FD length
+		frameBytes[4] = canFDValidLen(f.DLC)
+		// byte 5: FD flags
+		if f.BRS {
+			frameBytes[5] |= canFDBRSFlag
+		}
+		if f.ESI {
+			frameBytes[5] |= canFDESIFlag
+		}
+	} else {
+		if f.DLC > CANMaxDLen {
+			return 0, fmt.Errorf("DLC %d exceeds classic CAN maximum", f.DLC)
+		}
+		// byte 4: data length code
+		frameBytes[4] = f.DLC
+	}
+	binary.LittleEndian.PutUint32(frameBytes[0:4], id)
+
+	// data
+	n := int(f.DLC)
+	if n > len(f.Data) {
+		n = len(f.Data)
+	}
+	copy(frameBytes[8:], f.Data[:n])
+	return size, nil
+}
+
+// unmarshalFrame converts a struct can_frame or struct canfd_frame into a CANFrame.
+// The frame type is determined by the length of frameBytes.
+func unmarshalFrame(frameBytes []byte) *CANFrame {
+	f := &CANFrame{}
+
+	// bytes 0-3: ID
+	id := uint32(binary.LittleEndian.Uint32(frameBytes[0:4]))
+
+	if id&canEFFFlag == 0 {
+		// standard ID
+		f.ID = id & 0x7FF
+	} else {
+		// extended ID
+		f.ID = id & 0x1FFFFFFF
+		f.Extended = true
+	}
+	if id&canRTRFlag != 0 {
+		f.RTR = true
+	}
+
+	// byte 4: data length code
+	f.DLC = frameBytes[4]
+
+	if len(frameBytes) == canFDMTU {
+		f.FD = true
+		f.BRS = frameBytes[5]&canFDBRSFlag != 0
+		f.ESI = frameBytes[5]&canFDESIFlag != 0
+		if f.DLC > CANFDMaxDLen {
+			f.DLC = CANFDMaxDLen
+		}
+		f.Data = make([]byte, f.DLC)
+	} else {
+		f.Data = make([]byte, CANMaxDLen)
+	}
+	// data
+	copy(f.Data, frameBytes[8:])
+	return f
+}
+
+// canFDValidLen rounds n up to the next valid CAN FD payload length
+func canFDValidLen(n uint8) uint8 {
+	for _, l := range []uint8{8, 12, 16, 20, 24, 32, 48} {
+		if n <= l {
+			if n <= CANMaxDLen {
+				return n
+			}
+			return l
 		}
 	}
+	return CANFDMaxDLen
 }
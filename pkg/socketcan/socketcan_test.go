@@ -0,0 +1,101 @@
+package socketcan
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalClassicFrame(t *testing.T) {
+	f := &CANFrame{ID: 0x123, DLC: 3, Data: []byte{1, 2, 3}}
+	b, err := marshalFrame(f)
+	assert.Nil(t, err)
+	assert.Equal(t, canMTU, len(b))
+
+	r := unmarshalFrame(b)
+	assert.Equal(t, uint32(0x123), r.ID)
+	assert.Equal(t, uint8(3), r.DLC)
+	assert.Equal(t, []byte{1, 2, 3, 0, 0, 0, 0, 0}, r.Data)
+	assert.False(t, r.FD)
+
+	_, err = marshalFrame(&CANFrame{ID: 0x800})
+	assert.NotNil(t, err)
+	_, err = marshalFrame(&CANFrame{ID: 0x1, DLC: 9, Data: make([]byte, 9)})
+	assert.NotNil(t, err)
+}
+
+func TestMarshalFDFrame(t *testing.T) {
+	data := make([]byte, 64)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	f := &CANFrame{ID: 0x1abcdef, Extended: true, DLC: 64, Data: data, FD: true, BRS: true}
+	b, err := marshalFrame(f)
+	assert.Nil(t, err)
+	assert.Equal(t, canFDMTU, len(b))
+
+	r := unmarshalFrame(b)
+	assert.Equal(t, uint32(0x1abcdef), r.ID)
+	assert.True(t, r.Extended)
+	assert.True(t, r.FD)
+	assert.True(t, r.BRS)
+	assert.False(t, r.ESI)
+	assert.Equal(t, data, r.Data)
+
+	// payload length is rounded up to the next valid FD length
+	b, err = marshalFrame(&CANFrame{ID: 0x1, DLC: 10, Data: data[:10], FD: true})
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(12), b[4])
+}
+
+func TestParseFilters(t *testing.T) {
+	filters, errMask, err := ParseFilters("123:7FF,00000200~1FFFFF00,#FFFFFFFF")
+	assert.Nil(t, err)
+	assert.Equal(t, CANErrorClass(0xFFFFFFFF), errMask)
+	assert.Equal(t, []CANFilter{
+		{ID: 0x123, Mask: 0x7FF},
+		{ID: 0x80000200, Mask: 0x1FFFFF00, Inverted: true},
+	}, filters)
+
+	filters, errMask, err = ParseFilters("")
+	assert.Nil(t, err)
+	assert.Equal(t, CANErrorClass(0), errMask)
+	assert.Empty(t, filters)
+
+	// only an error mask: no filters, i.e. the data frame filters aren't changed
+	filters, errMask, err = ParseFilters("#4")
+	assert.Nil(t, err)
+	assert.Equal(t, CANErrCtrl, errMask)
+	assert.Nil(t, filters)
+
+	_, _, err = ParseFilters("123")
+	assert.NotNil(t, err)
+	_, _, err = ParseFilters("xyz:7FF")
+	assert.NotNil(t, err)
+}
+
+func TestMarshalErrorFrame(t *testing.T) {
+	f := &CANErrorFrame{
+		ErrorClass:            CANErrCtrl | CANErrProt | CANErrTrx | CANErrLostArb | CANErrCnt,
+		ArbitrationLostBit:    12,
+		CANCtrlErrorDetails:   CANErrCtrlRxPassive | CANErrCtrlTxWarning,
+		ProtocolErrorType:     CANErrProtStuff | CANErrProtTx,
+		ProtocolErrorLocation: CANErrProtLocData,
+		TransceiverStatus:     CANErrTrxCANHNoWire,
+		ControllerSpecific:    0x55,
+		TxErrorCounter:        97,
+		RxErrorCounter:        128,
+	}
+	b := marshalErrorFrame(f)
+	assert.Equal(t, canMTU, len(b))
+	assert.Equal(t, []byte{0x1E, 0x02, 0x00, 0x20, canErrDLC, 0, 0, 0, 12, 0x18, 0x84, 0x0A, 0x04, 0x55, 97, 128}, b)
+	assert.Equal(t, f, unmarshalErrorFrame(b))
+
+	assert.Equal(t, "error frame: lost-arbitration,controller-problem,protocol-violation,transceiver-status,error-counter"+
+		" lost-arbitration-bit 12 controller {tx-error-warning,rx-error-passive}"+
+		" protocol {type 0x84, location 0x0a} transceiver 0x04 error-counter-tx-rx {97,128}", f.String())
+
+	// counters are only sent with CANErrCnt
+	b = marshalErrorFrame(&CANErrorFrame{ErrorClass: CANErrBusOff, TxErrorCounter: 255})
+	assert.Equal(t, byte(0), b[14])
+}